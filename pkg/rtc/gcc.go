@@ -0,0 +1,436 @@
+package rtc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	// transportCCExtensionURI is the header extension a transport-cc
+	// sender tags every RTP packet with a transport-wide, monotonic
+	// sequence number, so the receiving side can report back detailed
+	// per-packet arrival feedback.
+	transportCCExtensionURI = "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"
+
+	// gccFeedbackInterval is how often the receive side of a
+	// transport-cc stream reports arrival feedback back to the sender.
+	gccFeedbackInterval = 100 * time.Millisecond
+
+	// twccDeltaUnit is the tick size RecvDelta values are encoded in.
+	twccDeltaUnit = 250 * time.Microsecond
+
+	// gccKalmanGain and gccChiSquare tune the single-state Kalman filter
+	// the trendline estimator runs over inter-group delay variation,
+	// following the values libwebrtc's overuse detector uses.
+	gccKalmanGain = 1.0 / 12.5
+	gccChiSquare  = 0.1
+
+	// gccOveruseTimeThresh is how long the trend has to stay above
+	// threshold before we call it an overuse rather than a jitter blip.
+	gccOveruseTimeThresh = 10 * time.Millisecond
+
+	// gccLossHigh/gccLossLow are the loss-ratio thresholds driving the
+	// loss-based estimator's multiplicative decrease / additive increase.
+	gccLossHigh = 0.10
+	gccLossLow  = 0.02
+
+	// gccMinBitrate/gccMaxBitrate bound both estimators, in bytes/sec.
+	// The old fixed REMB clamp capped every stream at rembHighBW; GCC is
+	// allowed to climb much higher.
+	gccMinBitrate = rembLowBW
+	gccMaxBitrate = 2 * 1000 * 1000
+)
+
+// overuseState is the arrival-time filter's classification of the
+// current network conditions.
+type overuseState int
+
+const (
+	overuseNormal overuseState = iota
+	overuseUnderuse
+	overuseOverusing
+)
+
+// trendlineEstimator is a single-state Kalman filter over inter-group
+// delay variation, used to classify the network as over-, under- or
+// normally-used. It mirrors libwebrtc's overuse detector, simplified to
+// operate per-packet rather than grouping packets into bursts first.
+type trendlineEstimator struct {
+	mu sync.Mutex
+
+	threshold float64
+	estimate  float64
+	varNoise  float64
+	state     overuseState
+	overuseAt time.Time
+}
+
+func newTrendlineEstimator() *trendlineEstimator {
+	return &trendlineEstimator{threshold: 12.5, varNoise: 50}
+}
+
+// update feeds a new inter-group delay variation sample (in ms) into the
+// filter and returns the resulting over-use state.
+func (e *trendlineEstimator) update(deltaMS float64, now time.Time) overuseState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	residual := deltaMS - e.estimate
+	gain := gccKalmanGain * (e.varNoise / (e.varNoise + gccChiSquare))
+	e.estimate += gain * residual
+	e.varNoise += gccChiSquare
+
+	k := 0.01
+	if absF(e.estimate) > e.threshold {
+		k = 0.05
+	}
+	e.threshold += k * (absF(e.estimate) - e.threshold)
+	if e.threshold < 6 {
+		e.threshold = 6
+	}
+	if e.threshold > 600 {
+		e.threshold = 600
+	}
+
+	switch {
+	case e.estimate > e.threshold:
+		if e.overuseAt.IsZero() {
+			e.overuseAt = now
+		}
+		if now.Sub(e.overuseAt) > gccOveruseTimeThresh {
+			e.state = overuseOverusing
+		}
+	case e.estimate < -e.threshold:
+		e.overuseAt = time.Time{}
+		e.state = overuseUnderuse
+	default:
+		e.overuseAt = time.Time{}
+		e.state = overuseNormal
+	}
+	return e.state
+}
+
+func absF(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+// gccBandwidthEstimator is a minimal Google Congestion Control estimator:
+// an arrival-time (delay-based) filter combined with a loss-based
+// estimator, taking the minimum of the two as the target bitrate. One
+// lives on a subscriber-facing WebRTCTransport, fed by the transport-cc
+// feedback that subscriber sends back for what we forwarded it.
+type gccBandwidthEstimator struct {
+	mu sync.Mutex
+
+	trendline *trendlineEstimator
+
+	haveLast bool
+	lastSend time.Time
+	lastRecv time.Time
+
+	// lastState and haveDelayUpdate hold the trendline's overuse
+	// classification as of the most recent updateDelay call, consumed
+	// once per feedback report by applyDelayEstimate rather than per
+	// packet; haveDelayUpdate is false whenever there's nothing new for
+	// applyDelayEstimate to act on, e.g. a report with no matched packets.
+	lastState       overuseState
+	haveDelayUpdate bool
+
+	delayBitrate uint64
+	lossBitrate  uint64
+}
+
+func newGCCBandwidthEstimator() *gccBandwidthEstimator {
+	return &gccBandwidthEstimator{
+		trendline:    newTrendlineEstimator(),
+		delayBitrate: gccMinBitrate,
+		lossBitrate:  gccMinBitrate,
+	}
+}
+
+// updateDelay feeds one packet's send and arrival time into the
+// arrival-time filter, recording the resulting over-use state for
+// applyDelayEstimate to act on. It does not itself adjust delayBitrate:
+// a single feedback report can cover a few dozen packets, and applying
+// the AIMD step on every one of them would compound a single report's
+// worth of overuse into a multi-step crash in the estimate.
+func (g *gccBandwidthEstimator) updateDelay(sendTime, arrival time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.haveLast {
+		g.lastSend, g.lastRecv, g.haveLast = sendTime, arrival, true
+		return
+	}
+
+	sendDelta := sendTime.Sub(g.lastSend)
+	recvDelta := arrival.Sub(g.lastRecv)
+	g.lastSend, g.lastRecv = sendTime, arrival
+
+	d := recvDelta - sendDelta
+	g.lastState = g.trendline.update(float64(d.Microseconds())/1000, arrival)
+	g.haveDelayUpdate = true
+}
+
+// applyDelayEstimate applies one AIMD step to the delay-based bitrate
+// using the overuse state the most recent updateDelay call saw, then
+// clears it so a feedback report with no matched packets doesn't repeat
+// the previous report's adjustment. Callers run this once per feedback
+// report, after every updateDelay call for that report.
+func (g *gccBandwidthEstimator) applyDelayEstimate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.haveDelayUpdate {
+		return
+	}
+	switch g.lastState {
+	case overuseOverusing:
+		g.delayBitrate = uint64(float64(g.delayBitrate) * 0.85)
+	case overuseNormal:
+		g.delayBitrate = uint64(float64(g.delayBitrate) * 1.05)
+	}
+	g.delayBitrate = clampBitrate(g.delayBitrate)
+	g.haveDelayUpdate = false
+}
+
+// updateLoss adjusts the loss-based estimate: multiplicative decrease
+// above a 10% loss ratio, additive increase below 2%, unchanged between.
+func (g *gccBandwidthEstimator) updateLoss(lossRatio float64, currentBitrate uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case lossRatio > gccLossHigh:
+		g.lossBitrate = uint64(float64(currentBitrate) * (1 - lossRatio))
+	case lossRatio < gccLossLow:
+		g.lossBitrate = currentBitrate + uint64(float64(currentBitrate)*0.05) + 1000
+	default:
+		g.lossBitrate = currentBitrate
+	}
+	g.lossBitrate = clampBitrate(g.lossBitrate)
+}
+
+// target returns the combined estimate: GCC always takes the more
+// conservative of the delay-based and loss-based estimators.
+func (g *gccBandwidthEstimator) target() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.delayBitrate < g.lossBitrate {
+		return g.delayBitrate
+	}
+	return g.lossBitrate
+}
+
+func clampBitrate(bw uint64) uint64 {
+	if bw < gccMinBitrate {
+		return gccMinBitrate
+	}
+	if bw > gccMaxBitrate {
+		return gccMaxBitrate
+	}
+	return bw
+}
+
+// twccFeedbackGenerator accumulates arrival times for a transport-wide
+// sequence number range and builds the rtcp.TransportLayerCC reporting
+// them, per the receiving side of transport-cc. One lives on a
+// publish-facing WebRTCTransport.
+type twccFeedbackGenerator struct {
+	mu         sync.Mutex
+	have       bool
+	baseSeq    uint16
+	lastSeq    uint16
+	arrivals   map[uint16]time.Time
+	fbPktCount uint8
+}
+
+func newTWCCFeedbackGenerator() *twccFeedbackGenerator {
+	return &twccFeedbackGenerator{arrivals: make(map[uint16]time.Time)}
+}
+
+// onPacket records that seq arrived at t, for inclusion in the next
+// feedback report.
+func (g *twccFeedbackGenerator) onPacket(seq uint16, t time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.have {
+		g.baseSeq, g.lastSeq, g.have = seq, seq, true
+	} else {
+		if seq < g.baseSeq {
+			g.baseSeq = seq
+		}
+		if seq > g.lastSeq {
+			g.lastSeq = seq
+		}
+	}
+	g.arrivals[seq] = t
+}
+
+// build returns the TransportLayerCC packet reporting every arrival
+// recorded since the last build, or nil if nothing arrived.
+func (g *twccFeedbackGenerator) build(senderSSRC, mediaSSRC uint32) *rtcp.TransportLayerCC {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.have {
+		return nil
+	}
+
+	count := g.lastSeq - g.baseSeq + 1
+	statuses := make([]uint16, count)
+	deltas := make([]*rtcp.RecvDelta, 0, count)
+	var refTime, prev time.Time
+	for i := uint16(0); i < count; i++ {
+		arrival, ok := g.arrivals[g.baseSeq+i]
+		if !ok {
+			statuses[i] = rtcp.TypeTCCPacketNotReceived
+			continue
+		}
+		if refTime.IsZero() {
+			refTime, prev = arrival, arrival
+		}
+		d := arrival.Sub(prev)
+		prev = arrival
+		if d < 0 {
+			d = 0
+		}
+		symbol := uint16(rtcp.TypeTCCPacketReceivedSmallDelta)
+		if d > 63*twccDeltaUnit {
+			symbol = rtcp.TypeTCCPacketReceivedLargeDelta
+		}
+		statuses[i] = symbol
+		deltas = append(deltas, &rtcp.RecvDelta{Type: symbol, Delta: d.Microseconds()})
+	}
+
+	fb := &rtcp.TransportLayerCC{
+		SenderSSRC:         senderSSRC,
+		MediaSSRC:          mediaSSRC,
+		BaseSequenceNumber: g.baseSeq,
+		PacketStatusCount:  count,
+		ReferenceTime:      uint32(refTime.UnixNano() / int64(64*time.Millisecond)),
+		FbPktCount:         g.fbPktCount,
+		PacketChunks:       buildTWCCChunks(statuses),
+		RecvDeltas:         deltas,
+	}
+	g.fbPktCount++
+	g.arrivals = make(map[uint16]time.Time)
+	g.have = false
+	return fb
+}
+
+// buildTWCCChunks run-length encodes a slice of per-packet status symbols
+// into the chunks a TransportLayerCC packet carries.
+func buildTWCCChunks(statuses []uint16) []rtcp.PacketStatusChunk {
+	var chunks []rtcp.PacketStatusChunk
+	for i := 0; i < len(statuses); {
+		j := i + 1
+		for j < len(statuses) && j-i < 0x1fff && statuses[j] == statuses[i] {
+			j++
+		}
+		chunks = append(chunks, &rtcp.RunLengthChunk{
+			Type:               rtcp.TypeTCCRunLengthChunk,
+			PacketStatusSymbol: statuses[i],
+			RunLength:          uint16(j - i),
+		})
+		i = j
+	}
+	return chunks
+}
+
+// twccSendHistorySize bounds the ring buffer below the same way
+// packetCache bounds its own: sequence numbers map to slots modulo this
+// size, which limits how stale a send timestamp can be and still be
+// matched back up against returning feedback.
+const twccSendHistorySize = 8192
+
+type twccSendEntry struct {
+	seq   uint16
+	valid bool
+	sent  time.Time
+}
+
+// twccSendHistory is a per-subscriber ring buffer of outbound packet send
+// times, indexed by transport-wide sequence number, mirroring
+// packetCache's layout.
+type twccSendHistory struct {
+	mu      sync.Mutex
+	entries [twccSendHistorySize]twccSendEntry
+}
+
+func newTWCCSendHistory() *twccSendHistory {
+	return &twccSendHistory{}
+}
+
+func (h *twccSendHistory) record(seq uint16, sent time.Time) {
+	h.mu.Lock()
+	h.entries[seq%twccSendHistorySize] = twccSendEntry{seq: seq, valid: true, sent: sent}
+	h.mu.Unlock()
+}
+
+// take returns and clears the send time recorded for seq, if any.
+func (h *twccSendHistory) take(seq uint16) (time.Time, bool) {
+	idx := seq % twccSendHistorySize
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.entries[idx]
+	if !e.valid || e.seq != seq {
+		return time.Time{}, false
+	}
+	h.entries[idx].valid = false
+	return e.sent, true
+}
+
+// extmapID scans sdp for an "a=extmap:<id>[/direction] <uri>" line and
+// returns the negotiated extension id, or 0 if the remote side didn't
+// offer it.
+func extmapID(sdp, uri string) uint8 {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=extmap:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[len(fields)-1] != uri {
+			continue
+		}
+		idField := strings.SplitN(strings.TrimPrefix(fields[0], "a=extmap:"), "/", 2)[0]
+		id, err := strconv.Atoi(idField)
+		if err != nil {
+			continue
+		}
+		return uint8(id)
+	}
+	return 0
+}
+
+// setTWCCExtension tags pkt with seq as a transport-cc RTP header
+// extension under id.
+func setTWCCExtension(pkt *rtp.Packet, id uint8, seq uint16) {
+	ext := rtp.TransportCCExtension{TransportSequence: seq}
+	payload, err := ext.Marshal()
+	if err != nil {
+		return
+	}
+	pkt.SetExtension(id, payload)
+}
+
+// twccSeq extracts the transport-wide sequence number tagged under id in
+// pkt's header extension, if present.
+func twccSeq(pkt *rtp.Packet, id uint8) (uint16, bool) {
+	payload := pkt.GetExtension(id)
+	if payload == nil {
+		return 0, false
+	}
+	var ext rtp.TransportCCExtension
+	if err := ext.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return ext.TransportSequence, true
+}
@@ -0,0 +1,70 @@
+package rtc
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTrendlineEstimatorDetectsOveruse feeds a sustained positive
+// inter-group delay variation (as a real overuse would produce) and
+// expects the filter to eventually classify it as overuseOverusing
+// rather than staying in overuseNormal/underuse.
+func TestTrendlineEstimatorDetectsOveruse(t *testing.T) {
+	e := newTrendlineEstimator()
+	base := time.Unix(0, 0)
+
+	var state overuseState
+	for i := 0; i < 50; i++ {
+		state = e.update(50, base.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	if state != overuseOverusing {
+		t.Errorf("state = %v, want overuseOverusing", state)
+	}
+}
+
+// TestNewGCCBandwidthEstimatorStartsConservative guards against seeding
+// the estimate at gccMaxBitrate, which would request the top simulcast
+// layer before any probing has happened.
+func TestNewGCCBandwidthEstimatorStartsConservative(t *testing.T) {
+	g := newGCCBandwidthEstimator()
+	if g.target() != gccMinBitrate {
+		t.Errorf("initial target() = %d, want gccMinBitrate (%d)", g.target(), gccMinBitrate)
+	}
+}
+
+// TestApplyDelayEstimateOncePerReport checks that several updateDelay
+// calls within a single feedback report only move delayBitrate by one
+// AIMD step, applied by the single applyDelayEstimate call - not once
+// per packet, which would compound a whole report's worth of overuse
+// into a multi-step crash in the estimate.
+func TestApplyDelayEstimateOncePerReport(t *testing.T) {
+	g := newGCCBandwidthEstimator()
+	// Start well above gccMinBitrate so that compounded per-packet steps
+	// would not be hidden by clampBitrate's floor.
+	g.delayBitrate = gccMaxBitrate
+	before := g.delayBitrate
+
+	base := time.Unix(0, 0)
+	send := base
+	// Feed enough consistently-overusing samples to push the trendline
+	// filter into overuseOverusing (mirrors TestTrendlineEstimatorDetectsOveruse).
+	for i := 0; i < 50; i++ {
+		arrival := base.Add(time.Duration(i) * 70 * time.Millisecond)
+		g.updateDelay(send, arrival)
+		send = send.Add(20 * time.Millisecond)
+	}
+	g.applyDelayEstimate()
+
+	want := clampBitrate(uint64(float64(before) * 0.85))
+	if g.delayBitrate != want {
+		t.Errorf("delayBitrate after one applyDelayEstimate = %d, want %d (single 0.85 step)", g.delayBitrate, want)
+	}
+
+	// A second, unrelated report with no updateDelay calls in between
+	// must not repeat the previous report's adjustment.
+	before = g.delayBitrate
+	g.applyDelayEstimate()
+	if g.delayBitrate != before {
+		t.Errorf("delayBitrate changed with no updateDelay calls: got %d, want unchanged %d", g.delayBitrate, before)
+	}
+}
@@ -0,0 +1,227 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/ion/pkg/log"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+)
+
+// minPLIInterval is the minimum time between two keyframe requests for
+// the same SSRC, so a PLI storm (many subscribers joining at once, or a
+// run of NACKable loss) collapses into a single upstream request.
+const minPLIInterval = 500 * time.Millisecond
+
+// pliBeforeFIR is how many PLIs in a row may go unanswered (no keyframe
+// seen) before escalating to a FIR, per RFC 5104's guidance that FIR is
+// a stronger, "reliable" fallback rather than the first tool reached for.
+const pliBeforeFIR = 3
+
+// keyFrameDetector watches one video SSRC's inbound RTP and reports
+// whether a keyframe has been seen since the last call to sinceRequest,
+// so the PLI/FIR requester can tell whether its last request worked.
+type keyFrameDetector struct {
+	codec string // "h264", "vp8" or "vp9"
+
+	mu   sync.Mutex
+	seen bool
+
+	h264 codecs.H264Packet
+	vp8  codecs.VP8Packet
+	vp9  codecs.VP9Packet
+}
+
+func newKeyFrameDetector(codec string) *keyFrameDetector {
+	return &keyFrameDetector{codec: codec}
+}
+
+// observe unmarshals pkt with the codec-appropriate depacketizer and
+// records whether it is (or starts) a keyframe. For H.264 this only
+// needs the first fragment of an IDU, since pion/rtp/codecs' H264Packet
+// reconstructs the NALU header on a FU-A start fragment already.
+func (d *keyFrameDetector) observe(pkt *rtp.Packet) {
+	var isKeyFrame bool
+	switch d.codec {
+	case "h264":
+		nalu, err := d.h264.Unmarshal(pkt.Payload)
+		if err != nil {
+			return
+		}
+		isKeyFrame = isH264KeyFrame(nalu)
+	case "vp8":
+		payload, err := d.vp8.Unmarshal(pkt.Payload)
+		if err != nil {
+			return
+		}
+		isKeyFrame = isVP8KeyFrame(payload)
+	case "vp9":
+		payload, err := d.vp9.Unmarshal(pkt.Payload)
+		if err != nil {
+			return
+		}
+		isKeyFrame = isVP9KeyFrame(payload)
+	default:
+		return
+	}
+
+	if !isKeyFrame {
+		return
+	}
+	d.mu.Lock()
+	d.seen = true
+	d.mu.Unlock()
+}
+
+// sinceRequest reports whether a keyframe has arrived since the last
+// call, clearing the flag for the next round.
+func (d *keyFrameDetector) sinceRequest() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := d.seen
+	d.seen = false
+	return seen
+}
+
+// pliRequester tracks per-SSRC keyframe-request state: the last time a
+// request went out (for rate limiting), how many PLIs in a row have
+// gone unanswered (for the FIR escalation), and the next FIR sequence
+// number RFC 5104 requires to increment on every request.
+type pliRequester struct {
+	mu        sync.Mutex
+	lastSent  map[uint32]time.Time
+	pliStreak map[uint32]int
+	firSeq    map[uint32]uint8
+	detectors map[uint32]*keyFrameDetector
+}
+
+func newPLIRequester() *pliRequester {
+	return &pliRequester{
+		lastSent:  make(map[uint32]time.Time),
+		pliStreak: make(map[uint32]int),
+		firSeq:    make(map[uint32]uint8),
+		detectors: make(map[uint32]*keyFrameDetector),
+	}
+}
+
+func (r *pliRequester) detectorFor(ssrc uint32, codec string) *keyFrameDetector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.detectors[ssrc]
+	if !ok {
+		d = newKeyFrameDetector(codec)
+		r.detectors[ssrc] = d
+	}
+	return d
+}
+
+// shouldSend enforces minPLIInterval per SSRC and reports whether this
+// request should escalate straight to a FIR: pliBeforeFIR PLIs have gone
+// by with no keyframe observed, and this SSRC has a registered detector
+// to judge that from. Once escalated, every following request is a FIR
+// until the detector reports a keyframe.
+func (r *pliRequester) shouldSend(ssrc uint32) (send, useFIR bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if last, ok := r.lastSent[ssrc]; ok && time.Since(last) < minPLIInterval {
+		return false, false
+	}
+	r.lastSent[ssrc] = time.Now()
+
+	d, haveDetector := r.detectors[ssrc]
+	if haveDetector && d.sinceRequest() {
+		// The previous request already produced a keyframe; start a
+		// fresh run of PLIs for this new loss event.
+		r.pliStreak[ssrc] = 0
+	}
+
+	if haveDetector && r.pliStreak[ssrc] >= pliBeforeFIR {
+		r.firSeq[ssrc]++
+		return true, true
+	}
+	r.pliStreak[ssrc]++
+	return true, false
+}
+
+func (r *pliRequester) firSequence(ssrc uint32) uint8 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.firSeq[ssrc]
+}
+
+// observeKeyFrameSniffing feeds pkt to ssrc's detector, if this publish
+// has a registered video codec to sniff keyframes for. RequestKeyFrame
+// consults the detector's accumulated state the next time it considers
+// escalating to a FIR.
+func (t *WebRTCTransport) observeKeyFrameSniffing(pkt *rtp.Packet) {
+	if t.pli == nil {
+		return
+	}
+	codec := videoCodecName(t.ssrcPayloadType(pkt.SSRC))
+	if codec == "" {
+		return
+	}
+	t.pli.detectorFor(pkt.SSRC, codec).observe(pkt)
+}
+
+func (t *WebRTCTransport) ssrcPayloadType(ssrc uint32) uint8 {
+	t.ssrcPTLock.RLock()
+	defer t.ssrcPTLock.RUnlock()
+	return t.ssrcPT[ssrc]
+}
+
+func videoCodecName(pt uint8) string {
+	switch pt {
+	case webrtc.DefaultPayloadTypeVP8:
+		return "vp8"
+	case webrtc.DefaultPayloadTypeVP9:
+		return "vp9"
+	case webrtc.DefaultPayloadTypeH264:
+		return "h264"
+	default:
+		return ""
+	}
+}
+
+// RequestKeyFrame asks this publish's sender for a new keyframe on ssrc,
+// rate-limited to minPLIInterval and escalating to a FIR once
+// pliBeforeFIR consecutive PLIs have failed to produce one. It is the
+// event-driven replacement for the old fixed-interval PLI ticker: call
+// it when a new subscriber attaches and needs a decodable start, when
+// cachePacket reports an unrecoverable gap in the reference layer, or
+// when a subscriber's own PLI is relayed up via subReadRTCP.
+func (t *WebRTCTransport) RequestKeyFrame(ssrc uint32) {
+	if t.pc == nil {
+		return
+	}
+	if t.pli == nil {
+		t.pliLock.Lock()
+		if t.pli == nil {
+			t.pli = newPLIRequester()
+		}
+		t.pliLock.Unlock()
+	}
+
+	send, useFIR := t.pli.shouldSend(ssrc)
+	if !send {
+		return
+	}
+
+	if useFIR {
+		log.Debugf("WebRTCTransport.RequestKeyFrame FIR ssrc=%v", ssrc)
+		fir := &rtcp.FullIntraRequest{
+			SenderSSRC: ssrc,
+			MediaSSRC:  ssrc,
+			FIR:        []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: t.pli.firSequence(ssrc)}},
+		}
+		t.pc.WriteRTCP([]rtcp.Packet{fir})
+		return
+	}
+
+	log.Debugf("WebRTCTransport.RequestKeyFrame PLI ssrc=%v", ssrc)
+	t.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{SenderSSRC: ssrc, MediaSSRC: ssrc}})
+}
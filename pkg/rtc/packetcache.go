@@ -0,0 +1,75 @@
+package rtc
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// packetCacheSize is the number of slots in a packetCache ring buffer.
+// Sequence numbers are mapped to slots with seqno % packetCacheSize, so
+// this bounds how far behind the current seqno a packet can still be
+// retransmitted from the cache.
+const packetCacheSize = 512
+
+type cacheEntry struct {
+	seqno uint16
+	valid bool
+	data  []byte
+}
+
+// packetCache is a per-SSRC ring buffer of recently sent/received RTP
+// packets, keyed by sequence number. It lets a NACK be answered directly
+// from memory instead of always round-tripping to the original sender.
+type packetCache struct {
+	mu      sync.RWMutex
+	entries [packetCacheSize]cacheEntry
+
+	haveLast bool
+	lastSeq  uint16
+}
+
+func newPacketCache() *packetCache {
+	return &packetCache{}
+}
+
+// Push stores pkt's marshaled bytes, overwriting whatever previously
+// occupied its slot, and reports whether this packet arrived after a
+// gap in sequence numbers larger than the cache window: one big enough
+// that the missing packets, if ever NACKed, could no longer be answered
+// from this cache and are an unrecoverable loss for the reference layer.
+func (c *packetCache) Push(pkt *rtp.Packet) (unrecoverableGap bool, err error) {
+	data, err := pkt.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	idx := pkt.SequenceNumber % packetCacheSize
+	c.mu.Lock()
+	if c.haveLast {
+		gap := int32(int16(pkt.SequenceNumber - c.lastSeq))
+		if gap > packetCacheSize {
+			unrecoverableGap = true
+		}
+	}
+	c.lastSeq = pkt.SequenceNumber
+	c.haveLast = true
+	c.entries[idx] = cacheEntry{seqno: pkt.SequenceNumber, valid: true, data: data}
+	c.mu.Unlock()
+	return unrecoverableGap, nil
+}
+
+// Get returns the marshaled RTP packet for seqno, if it is still in the
+// cache. The seqno is checked against the slot's stored seqno to detect
+// the case where a newer packet has already overwritten it.
+func (c *packetCache) Get(seqno uint16) ([]byte, bool) {
+	idx := seqno % packetCacheSize
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e := c.entries[idx]
+	if !e.valid || e.seqno != seqno {
+		return nil, false
+	}
+	return e.data, true
+}
@@ -0,0 +1,365 @@
+package rtc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/ion/pkg/log"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v2"
+)
+
+// recorderJitterBufferSize bounds how long the reorder buffer below will
+// wait for a gap before giving up on it, the same tradeoff packetCache's
+// ring makes for NACK: past this many outstanding packets, a hole is
+// assumed to be a genuine loss rather than reordering.
+const recorderJitterBufferSize = 64
+
+// recorderJitterBuffer reorders one SSRC's packets by sequence number
+// before they reach a depacketizer, which (unlike live playback) cannot
+// tolerate receiving a frame's fragments out of order.
+type recorderJitterBuffer struct {
+	mu       sync.Mutex
+	packets  map[uint16]*rtp.Packet
+	nextSeq  uint16
+	haveNext bool
+}
+
+func newRecorderJitterBuffer() *recorderJitterBuffer {
+	return &recorderJitterBuffer{packets: make(map[uint16]*rtp.Packet)}
+}
+
+// push adds pkt to the buffer and returns, in sequence order, every
+// packet now ready to be depacketized. A packet becomes ready either
+// because its sequence number is the next expected one, or because the
+// buffer has grown past recorderJitterBufferSize waiting on a gap, at
+// which point that gap is skipped rather than stalling the recording
+// forever.
+func (b *recorderJitterBuffer) push(pkt *rtp.Packet) []*rtp.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.haveNext {
+		b.nextSeq = pkt.SequenceNumber
+		b.haveNext = true
+	}
+	b.packets[pkt.SequenceNumber] = pkt
+
+	var ready []*rtp.Packet
+	for {
+		if p, ok := b.packets[b.nextSeq]; ok {
+			ready = append(ready, p)
+			delete(b.packets, b.nextSeq)
+			b.nextSeq++
+			continue
+		}
+		if len(b.packets) >= recorderJitterBufferSize {
+			b.nextSeq++
+			continue
+		}
+		break
+	}
+	return ready
+}
+
+// rtpClock turns wrapping 32-bit RTP timestamps into a monotonically
+// increasing presentation timestamp, in the track's own clock rate.
+type rtpClock struct {
+	rate     uint32
+	haveLast bool
+	lastRTP  uint32
+	pts      int64
+}
+
+func newRTPClock(rate uint32) *rtpClock {
+	return &rtpClock{rate: rate}
+}
+
+// normalize returns the accumulated PTS for ts. The subtraction is done
+// in int32 so a wraparound of the 32-bit RTP clock still yields the
+// correct (small, possibly negative-looking-if-misused) delta.
+func (c *rtpClock) normalize(ts uint32) int64 {
+	if !c.haveLast {
+		c.lastRTP = ts
+		c.haveLast = true
+		return c.pts
+	}
+	c.pts += int64(int32(ts - c.lastRTP))
+	c.lastRTP = ts
+	return c.pts
+}
+
+// isH264KeyFrame reports whether an Annex-B NALU (as pion/rtp/codecs'
+// H264Packet depacketizer returns it) starts an IDR access unit.
+func isH264KeyFrame(nalu []byte) bool {
+	if len(nalu) < 5 {
+		return false
+	}
+	naluType := nalu[4] & 0x1F
+	return naluType == 5 || naluType == 7
+}
+
+// isVP8KeyFrame reports whether a depacketized VP8 payload starts a key
+// frame, per the payload header's P bit (RFC 7741 section 4.3): P=0 means
+// this is a key frame.
+func isVP8KeyFrame(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x01 == 0
+}
+
+// isVP9KeyFrame reports whether a depacketized VP9 payload starts a key
+// frame. ion only needs frame boundaries here, not the full scalability
+// structure, so this reads just the frame-type bit of the uncompressed
+// header rather than fully parsing it.
+func isVP9KeyFrame(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x04 == 0
+}
+
+// sample is one decoded access unit/frame handed from a trackDepacketizer
+// to a muxer.
+type sample struct {
+	data      []byte
+	pts       int64
+	keyFrame  bool
+	timestamp time.Time
+}
+
+// sampleWriter is implemented by a recorder for each track it muxes.
+type sampleWriter interface {
+	writeSample(s sample) error
+}
+
+// trackDepacketizer reorders one SSRC's packets through a jitter buffer,
+// depacketizes them with the codec-appropriate pion/rtp/codecs
+// depacketizer, derives a wraparound-safe PTS, and flags keyframes so the
+// muxer knows when it may cut a new segment.
+type trackDepacketizer struct {
+	codec string // "h264", "vp8", "vp9" or "opus"
+	clock *rtpClock
+	jb    *recorderJitterBuffer
+	out   sampleWriter
+
+	h264      codecs.H264Packet
+	vp8       codecs.VP8Packet
+	vp9       codecs.VP9Packet
+	opus      codecs.OpusPacket
+	h264Frame []byte
+	vpxFrame  []byte
+}
+
+func newTrackDepacketizer(codecName string, clockRate uint32, out sampleWriter) *trackDepacketizer {
+	return &trackDepacketizer{
+		codec: codecName,
+		clock: newRTPClock(clockRate),
+		jb:    newRecorderJitterBuffer(),
+		out:   out,
+	}
+}
+
+func (d *trackDepacketizer) push(pkt *rtp.Packet) error {
+	for _, p := range d.jb.push(pkt) {
+		if err := d.depacketize(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *trackDepacketizer) depacketize(pkt *rtp.Packet) error {
+	pts := d.clock.normalize(pkt.Timestamp)
+	switch d.codec {
+	case "h264":
+		nalu, err := d.h264.Unmarshal(pkt.Payload)
+		if err != nil {
+			return err
+		}
+		d.h264Frame = append(d.h264Frame, nalu...)
+		if !pkt.Marker {
+			return nil
+		}
+		frame := d.h264Frame
+		d.h264Frame = nil
+		return d.out.writeSample(sample{data: frame, pts: pts, keyFrame: isH264KeyFrame(frame), timestamp: time.Now()})
+
+	case "vp8":
+		payload, err := d.vp8.Unmarshal(pkt.Payload)
+		if err != nil {
+			return err
+		}
+		d.vpxFrame = append(d.vpxFrame, payload...)
+		if !pkt.Marker {
+			return nil
+		}
+		frame := d.vpxFrame
+		d.vpxFrame = nil
+		return d.out.writeSample(sample{data: frame, pts: pts, keyFrame: isVP8KeyFrame(frame), timestamp: time.Now()})
+
+	case "vp9":
+		payload, err := d.vp9.Unmarshal(pkt.Payload)
+		if err != nil {
+			return err
+		}
+		d.vpxFrame = append(d.vpxFrame, payload...)
+		if !pkt.Marker {
+			return nil
+		}
+		frame := d.vpxFrame
+		d.vpxFrame = nil
+		return d.out.writeSample(sample{data: frame, pts: pts, keyFrame: isVP9KeyFrame(frame), timestamp: time.Now()})
+
+	case "opus":
+		payload, err := d.opus.Unmarshal(pkt.Payload)
+		if err != nil {
+			return err
+		}
+		return d.out.writeSample(sample{data: payload, pts: pts, timestamp: time.Now()})
+
+	default:
+		return fmt.Errorf("rtc: unsupported recorder codec %q", d.codec)
+	}
+}
+
+// recorderTracks fans WriteRTP out to the trackDepacketizer registered
+// for a packet's SSRC, so a Recorder can expose one entrypoint for a
+// mixed audio+video publish.
+type recorderTracks struct {
+	mu     sync.RWMutex
+	tracks map[uint32]*trackDepacketizer
+}
+
+func newRecorderTracks() *recorderTracks {
+	return &recorderTracks{tracks: make(map[uint32]*trackDepacketizer)}
+}
+
+func (r *recorderTracks) add(ssrc uint32, d *trackDepacketizer) {
+	r.mu.Lock()
+	r.tracks[ssrc] = d
+	r.mu.Unlock()
+}
+
+// WriteRTP depacketizes pkt on behalf of whichever track registered its
+// SSRC, silently dropping packets for SSRCs this recorder isn't watching.
+func (r *recorderTracks) WriteRTP(pkt *rtp.Packet) error {
+	r.mu.RLock()
+	d, ok := r.tracks[pkt.SSRC]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return d.push(pkt)
+}
+
+// Recorder persists a publisher's media to disk. WriteRTP is fed every
+// packet WebRTCTransport.receiveRTP hands to subscribers; Close flushes
+// and finalizes whatever container the implementation writes.
+type Recorder interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// RecorderFormat selects which Recorder implementation Record builds.
+type RecorderFormat int
+
+const (
+	// RecorderFormatFMP4 writes a single fragmented MP4 file (H.264/Opus).
+	RecorderFormatFMP4 RecorderFormat = iota
+	// RecorderFormatWebM writes a single Matroska/WebM file (VP8/VP9/Opus).
+	RecorderFormatWebM
+	// RecorderFormatHLS writes rolling fMP4 segments plus an m3u8 playlist.
+	RecorderFormatHLS
+)
+
+// RecorderConfig configures a Record call.
+type RecorderConfig struct {
+	// Format selects the container.
+	Format RecorderFormat
+
+	// Dir is where output is written: the single file for fMP4/WebM, or
+	// the init/segment/playlist files for HLS.
+	Dir string
+
+	// VideoCodec names the published video codec: "h264", "vp8" or "vp9".
+	// Leave empty to record audio only.
+	VideoCodec string
+
+	// HasAudio records the publish's Opus audio track alongside video.
+	HasAudio bool
+
+	// SegmentDuration is the minimum length of an HLS segment before the
+	// recorder cuts a new one on the next video keyframe; zero or less
+	// means 4 seconds. The fMP4 and WebM recorders ignore it: they write
+	// every sample as its own fragment/cluster.
+	SegmentDuration time.Duration
+}
+
+// Record attaches a Recorder to this publish-side transport. Every
+// packet receiveRTP hands to subscribers is also handed to the recorder,
+// so it observes the live stream without running its own RTCP loop.
+func (t *WebRTCTransport) Record(cfg RecorderConfig) error {
+	videoSSRC, audioSSRC, err := t.recorderSSRCs(cfg)
+	if err != nil {
+		return err
+	}
+
+	rec, err := newRecorder(cfg, videoSSRC, audioSSRC)
+	if err != nil {
+		return err
+	}
+
+	t.recorderLock.Lock()
+	t.recorder = rec
+	t.recorderLock.Unlock()
+	return nil
+}
+
+// recorderSSRCs picks the video/audio SSRCs this publish sends, matching
+// cfg's codec selection; audioSSRC is 0 if cfg.HasAudio is false.
+func (t *WebRTCTransport) recorderSSRCs(cfg RecorderConfig) (videoSSRC, audioSSRC uint32, err error) {
+	for ssrc, pt := range t.SSRCPT() {
+		switch pt {
+		case webrtc.DefaultPayloadTypeOpus:
+			if cfg.HasAudio {
+				audioSSRC = ssrc
+			}
+		default:
+			if cfg.VideoCodec != "" && videoCodecName(pt) == cfg.VideoCodec {
+				videoSSRC = ssrc
+			}
+		}
+	}
+
+	if cfg.VideoCodec != "" && videoSSRC == 0 {
+		return 0, 0, fmt.Errorf("rtc: Record: no published video track for codec %q", cfg.VideoCodec)
+	}
+	if cfg.HasAudio && audioSSRC == 0 {
+		return 0, 0, fmt.Errorf("rtc: Record: no published audio track")
+	}
+	return videoSSRC, audioSSRC, nil
+}
+
+func newRecorder(cfg RecorderConfig, videoSSRC, audioSSRC uint32) (Recorder, error) {
+	switch cfg.Format {
+	case RecorderFormatFMP4:
+		return newFMP4Recorder(cfg, videoSSRC, audioSSRC)
+	case RecorderFormatWebM:
+		return newWebMRecorder(cfg, videoSSRC, audioSSRC)
+	case RecorderFormatHLS:
+		return newHLSRecorder(cfg, videoSSRC, audioSSRC)
+	default:
+		return nil, fmt.Errorf("rtc: Record: unknown format %v", cfg.Format)
+	}
+}
+
+// closeRecorder is called from WebRTCTransport.Close.
+func (t *WebRTCTransport) closeRecorder() {
+	t.recorderLock.RLock()
+	rec := t.recorder
+	t.recorderLock.RUnlock()
+	if rec == nil {
+		return
+	}
+	if err := rec.Close(); err != nil {
+		log.Errorf("WebRTCTransport.closeRecorder err=%v", err)
+	}
+}
@@ -0,0 +1,460 @@
+package rtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fmp4TrackID values used in the moov/moof boxes this recorder writes:
+// 1 is always video (if present), 2 is always audio (if present).
+const (
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+)
+
+// box writes a single ISOBMFF box (a big-endian uint32 size, a four
+// character type, then payload) to w.
+func box(w *bytes.Buffer, boxType string, payload []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(8+len(payload)))
+	w.Write(size[:])
+	w.WriteString(boxType)
+	w.Write(payload)
+}
+
+// fullBox is a box whose payload begins with the ISOBMFF version+flags
+// header used by most "full boxes" (mvhd, tkhd, mdhd, ...).
+func fullBox(w *bytes.Buffer, boxType string, version byte, flags uint32, rest []byte) {
+	var payload bytes.Buffer
+	payload.WriteByte(version)
+	var flagBytes [4]byte
+	binary.BigEndian.PutUint32(flagBytes[:], flags)
+	payload.Write(flagBytes[1:])
+	payload.Write(rest)
+	box(w, boxType, payload.Bytes())
+}
+
+func be32(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func be16(v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return b[:]
+}
+
+// ftypBox writes the file-type box every ISOBMFF file starts with.
+func ftypBox() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("isom")
+	buf.Write(be32(512))
+	buf.WriteString("isom")
+	buf.WriteString("iso5")
+	buf.WriteString("mp42")
+	var out bytes.Buffer
+	box(&out, "ftyp", buf.Bytes())
+	return out.Bytes()
+}
+
+// identityMatrix is the unity transform ISOBMFF stores in tkhd/mvhd.
+var identityMatrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+// moovBox writes the movie box describing the video and/or audio track
+// this recording holds, with an mvex so players know to expect moof
+// fragments rather than a single mdat.
+func moovBox(hasVideo, hasAudio bool, videoCodec string) []byte {
+	var moov bytes.Buffer
+
+	var mvhdRest bytes.Buffer
+	mvhdRest.Write(be32(0)) // creation time
+	mvhdRest.Write(be32(0)) // modification time
+	mvhdRest.Write(be32(1000))
+	mvhdRest.Write(be32(0)) // duration, unknown for a fragmented file
+	mvhdRest.Write(be32(0x00010000))
+	mvhdRest.Write(be16(0x0100))
+	mvhdRest.Write(make([]byte, 2+8))
+	mvhdRest.Write(identityMatrix)
+	mvhdRest.Write(make([]byte, 24))
+	mvhdRest.Write(be32(uint32(fmp4AudioTrackID + 1)))
+	fullBox(&moov, "mvhd", 0, 0, mvhdRest.Bytes())
+
+	if hasVideo {
+		moov.Write(trakBox(fmp4VideoTrackID, true, videoCodec))
+	}
+	if hasAudio {
+		moov.Write(trakBox(fmp4AudioTrackID, false, ""))
+	}
+
+	var mvexTracks bytes.Buffer
+	if hasVideo {
+		mvexTracks.Write(trexBox(fmp4VideoTrackID))
+	}
+	if hasAudio {
+		mvexTracks.Write(trexBox(fmp4AudioTrackID))
+	}
+	var mvex bytes.Buffer
+	box(&mvex, "mvex", mvexTracks.Bytes())
+	moov.Write(mvex.Bytes())
+
+	var out bytes.Buffer
+	box(&out, "moov", moov.Bytes())
+	return out.Bytes()
+}
+
+func trexBox(trackID uint32) []byte {
+	var rest bytes.Buffer
+	rest.Write(be32(trackID))
+	rest.Write(be32(1)) // default sample description index
+	rest.Write(be32(0)) // default sample duration
+	rest.Write(be32(0)) // default sample size
+	rest.Write(be32(0)) // default sample flags
+	var out bytes.Buffer
+	fullBox(&out, "trex", 0, 0, rest.Bytes())
+	return out.Bytes()
+}
+
+func trakBox(trackID uint32, video bool, videoCodec string) []byte {
+	var trak bytes.Buffer
+
+	var tkhdRest bytes.Buffer
+	tkhdRest.Write(be32(0))
+	tkhdRest.Write(be32(0))
+	tkhdRest.Write(be32(trackID))
+	tkhdRest.Write(be32(0))
+	tkhdRest.Write(be32(0))
+	tkhdRest.Write(make([]byte, 8)) // reserved
+	tkhdRest.Write(be16(0))
+	tkhdRest.Write(be16(0))
+	if video {
+		tkhdRest.Write(be16(0))
+	} else {
+		tkhdRest.Write(be16(0x0100))
+	}
+	tkhdRest.Write(be16(0))
+	tkhdRest.Write(identityMatrix)
+	tkhdRest.Write(be32(0))
+	tkhdRest.Write(be32(0))
+	fullBox(&trak, "tkhd", 0, 0x000007, tkhdRest.Bytes())
+
+	var mdiaRest bytes.Buffer
+
+	var mdhdRest bytes.Buffer
+	rate := uint32(90000)
+	if !video {
+		rate = 48000
+	}
+	mdhdRest.Write(be32(0))
+	mdhdRest.Write(be32(0))
+	mdhdRest.Write(be32(rate))
+	mdhdRest.Write(be32(0))
+	mdhdRest.Write(be16(0x55c4))
+	mdhdRest.Write(be16(0))
+	var mdhd bytes.Buffer
+	fullBox(&mdhd, "mdhd", 0, 0, mdhdRest.Bytes())
+	mdiaRest.Write(mdhd.Bytes())
+
+	var hdlrRest bytes.Buffer
+	hdlrRest.Write(be32(0))
+	if video {
+		hdlrRest.WriteString("vide")
+	} else {
+		hdlrRest.WriteString("soun")
+	}
+	hdlrRest.Write(make([]byte, 12))
+	hdlrRest.WriteString("ion recorder\x00")
+	var hdlr bytes.Buffer
+	fullBox(&hdlr, "hdlr", 0, 0, hdlrRest.Bytes())
+	mdiaRest.Write(hdlr.Bytes())
+
+	mdiaRest.Write(minfBox(video, videoCodec))
+
+	var mdia bytes.Buffer
+	box(&mdia, "mdia", mdiaRest.Bytes())
+	trak.Write(mdia.Bytes())
+
+	var out bytes.Buffer
+	box(&out, "trak", trak.Bytes())
+	return out.Bytes()
+}
+
+func minfBox(video bool, videoCodec string) []byte {
+	var minf bytes.Buffer
+	if video {
+		var vmhd bytes.Buffer
+		fullBox(&vmhd, "vmhd", 0, 1, make([]byte, 8))
+		minf.Write(vmhd.Bytes())
+	} else {
+		var smhd bytes.Buffer
+		fullBox(&smhd, "smhd", 0, 0, make([]byte, 4))
+		minf.Write(smhd.Bytes())
+	}
+
+	var dref bytes.Buffer
+	dref.Write(be32(1))
+	var urlBox bytes.Buffer
+	fullBox(&urlBox, "url ", 0, 1, nil)
+	dref.Write(urlBox.Bytes())
+	var drefFull bytes.Buffer
+	fullBox(&drefFull, "dref", 0, 0, dref.Bytes())
+	var dinf bytes.Buffer
+	box(&dinf, "dinf", drefFull.Bytes())
+	minf.Write(dinf.Bytes())
+
+	minf.Write(stblBox(video, videoCodec))
+
+	var out bytes.Buffer
+	box(&out, "minf", minf.Bytes())
+	return out.Bytes()
+}
+
+func stblBox(video bool, videoCodec string) []byte {
+	var stsd bytes.Buffer
+	stsd.Write(be32(1))
+	if video {
+		stsd.Write(sampleEntryBox(videoCodec))
+	} else {
+		stsd.Write(sampleEntryBox("opus"))
+	}
+	var stsdFull bytes.Buffer
+	fullBox(&stsdFull, "stsd", 0, 0, stsd.Bytes())
+
+	var stbl bytes.Buffer
+	stbl.Write(stsdFull.Bytes())
+	emptyTable := func(boxType string) {
+		var b bytes.Buffer
+		fullBox(&b, boxType, 0, 0, be32(0))
+		stbl.Write(b.Bytes())
+	}
+	emptyTable("stts")
+	emptyTable("stsc")
+	emptyTable("stsz")
+	emptyTable("stco")
+
+	var out bytes.Buffer
+	box(&out, "stbl", stbl.Bytes())
+	return out.Bytes()
+}
+
+// sampleEntryBox writes a minimal video/audio sample entry. This
+// recorder stores raw Annex-B/VP8/VP9/Opus payloads rather than
+// per-codec extradata (avcC, dOps, ...), so the entry only carries
+// enough fields for a player to recognize the track; it's not a
+// byte-for-byte spec-complete sample description.
+func sampleEntryBox(codec string) []byte {
+	var name string
+	switch codec {
+	case "h264":
+		name = "avc1"
+	case "vp8":
+		name = "vp08"
+	case "vp9":
+		name = "vp09"
+	default:
+		name = "Opus"
+	}
+
+	var rest bytes.Buffer
+	rest.Write(make([]byte, 6)) // reserved
+	rest.Write(be16(1))         // data reference index
+	if name == "Opus" {
+		rest.Write(make([]byte, 8))
+		rest.Write(be16(2)) // channel count
+		rest.Write(be16(16))
+		rest.Write(make([]byte, 4))
+		rest.Write(be32(48000 << 16))
+	} else {
+		rest.Write(make([]byte, 16))
+		rest.Write(be16(1280))
+		rest.Write(be16(720))
+		rest.Write(be32(0x00480000))
+		rest.Write(be32(0x00480000))
+		rest.Write(be32(0))
+		rest.Write(be16(1))
+		rest.Write(make([]byte, 32))
+		rest.Write(be16(0x0018))
+		rest.Write(be16(0xffff))
+	}
+
+	var out bytes.Buffer
+	box(&out, name, rest.Bytes())
+	return out.Bytes()
+}
+
+// moofMdat writes one fragment (a moof describing a single sample
+// followed by its mdat payload), the unit this recorder flushes for
+// every sample. duration is this sample's
+// trun duration in the track's own RTP clock ticks, derived by the
+// caller from consecutive samples' PTS rather than a fixed tick count,
+// since the same function writes both the 90kHz video and 48kHz audio
+// track.
+func moofMdat(seq uint32, trackID uint32, duration uint32, s sample) []byte {
+	var traf bytes.Buffer
+
+	var tfhd bytes.Buffer
+	fullBox(&tfhd, "tfhd", 0, 0x020000, be32(trackID))
+	traf.Write(tfhd.Bytes())
+
+	var tfdt bytes.Buffer
+	fullBox(&tfdt, "tfdt", 1, 0, be64(uint64(s.pts)))
+	traf.Write(tfdt.Bytes())
+
+	flags := uint32(0x000301) // data-offset-present | sample-duration-present | sample-size-present
+	if !s.keyFrame && trackID == fmp4VideoTrackID {
+		flags |= 0x000400 // sample-flags-present, mark non-sync
+	}
+	var trun bytes.Buffer
+	var trunRest bytes.Buffer
+	trunRest.Write(be32(1))
+	trunRest.Write(be32(0)) // data offset, patched below once moof's size is known
+	trunRest.Write(be32(duration))
+	trunRest.Write(be32(uint32(len(s.data))))
+	if flags&0x000400 != 0 {
+		trunRest.Write(be32(0x00010000))
+	}
+	fullBox(&trun, "trun", 0, flags, trunRest.Bytes())
+	traf.Write(trun.Bytes())
+
+	var trafFull bytes.Buffer
+	box(&trafFull, "traf", traf.Bytes())
+
+	var mfhd bytes.Buffer
+	fullBox(&mfhd, "mfhd", 0, 0, be32(seq))
+
+	var moof bytes.Buffer
+	moof.Write(mfhd.Bytes())
+	moof.Write(trafFull.Bytes())
+	var moofFull bytes.Buffer
+	box(&moofFull, "moof", moof.Bytes())
+
+	var mdat bytes.Buffer
+	box(&mdat, "mdat", s.data)
+
+	// trun's data-offset counts from the start of moof to the first byte
+	// of sample data in the following mdat; patch it in now that both
+	// box sizes are known.
+	out := moofFull.Bytes()
+	offset := uint32(len(moofFull.Bytes()) + 8)
+	patchDataOffset(out, offset)
+
+	result := append(out, mdat.Bytes()...)
+	return result
+}
+
+// patchDataOffset overwrites the trun data-offset field (the first
+// sample-independent 4-byte field after trun's version/flags and
+// sample-count) now that the moof's total size is known.
+func patchDataOffset(moof []byte, offset uint32) {
+	idx := bytes.Index(moof, []byte("trun"))
+	if idx < 0 {
+		return
+	}
+	// trun payload: version+flags(4) + sample count(4) + data offset(4)
+	pos := idx + 4 + 4 + 4
+	if pos+4 > len(moof) {
+		return
+	}
+	binary.BigEndian.PutUint32(moof[pos:pos+4], offset)
+}
+
+func be64(v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+// fmp4Recorder writes one fragmented MP4 file containing an H.264 video
+// track and/or an Opus audio track, flushing a new moof/mdat fragment on
+// every sample.
+type fmp4Recorder struct {
+	*recorderTracks
+
+	mu     sync.Mutex
+	f      *os.File
+	seq    uint32
+	closed bool
+
+	// lastPTS holds each track's previous sample PTS (in that track's own
+	// RTP clock ticks), so writeFragment can derive the next trun's
+	// duration from the gap between consecutive samples.
+	lastPTS map[uint32]int64
+}
+
+func newFMP4Recorder(cfg RecorderConfig, videoSSRC, audioSSRC uint32) (*fmp4Recorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(cfg.Dir, "record.mp4"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &fmp4Recorder{recorderTracks: newRecorderTracks(), f: f, lastPTS: make(map[uint32]int64)}
+
+	if _, err := f.Write(ftypBox()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(moovBox(videoSSRC != 0, audioSSRC != 0, cfg.VideoCodec)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if videoSSRC != 0 {
+		r.add(videoSSRC, newTrackDepacketizer(cfg.VideoCodec, 90000, &fmp4TrackWriter{r: r, trackID: fmp4VideoTrackID, rate: 90000}))
+	}
+	if audioSSRC != 0 {
+		r.add(audioSSRC, newTrackDepacketizer("opus", 48000, &fmp4TrackWriter{r: r, trackID: fmp4AudioTrackID, rate: 48000}))
+	}
+	return r, nil
+}
+
+type fmp4TrackWriter struct {
+	r       *fmp4Recorder
+	trackID uint32
+	rate    uint32 // this track's RTP clock rate; rate/30 is the fallback duration for its first sample
+}
+
+func (w *fmp4TrackWriter) writeSample(s sample) error {
+	return w.r.writeFragment(w.trackID, w.rate, s)
+}
+
+// writeFragment flushes one moof/mdat fragment for trackID. duration is
+// derived from the gap to this track's previous sample's PTS; the very
+// first sample has no previous PTS to diff against, so it falls back to
+// one frame at a nominal 30fps in this track's own clock rate.
+func (r *fmp4Recorder) writeFragment(trackID uint32, rate uint32, s sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return fmt.Errorf("rtc: fmp4Recorder: write after Close")
+	}
+	duration := rate / 30
+	if prev, ok := r.lastPTS[trackID]; ok && s.pts > prev {
+		duration = uint32(s.pts - prev)
+	}
+	r.lastPTS[trackID] = s.pts
+	r.seq++
+	_, err := r.f.Write(moofMdat(r.seq, trackID, duration, s))
+	return err
+}
+
+func (r *fmp4Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.f.Close()
+}
@@ -0,0 +1,93 @@
+package rtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBox(t *testing.T) {
+	cases := []struct {
+		name    string
+		boxType string
+		payload []byte
+	}{
+		{"empty payload", "free", nil},
+		{"short payload", "mfhd", []byte{1, 2, 3, 4}},
+		{"longer payload", "moof", bytes.Repeat([]byte{0xAB}, 32)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			box(&buf, c.boxType, c.payload)
+			out := buf.Bytes()
+
+			wantSize := uint32(8 + len(c.payload))
+			if gotSize := binary.BigEndian.Uint32(out[0:4]); gotSize != wantSize {
+				t.Errorf("size = %d, want %d", gotSize, wantSize)
+			}
+			if gotType := string(out[4:8]); gotType != c.boxType {
+				t.Errorf("type = %q, want %q", gotType, c.boxType)
+			}
+			if !bytes.Equal(out[8:], c.payload) {
+				t.Errorf("payload = %v, want %v", out[8:], c.payload)
+			}
+		})
+	}
+}
+
+func TestPatchDataOffset(t *testing.T) {
+	var trun bytes.Buffer
+	var trunRest bytes.Buffer
+	trunRest.Write(be32(1))
+	trunRest.Write(be32(0)) // data offset, to be patched
+	trunRest.Write(be32(3000))
+	trunRest.Write(be32(100))
+	fullBox(&trun, "trun", 0, 0x000301, trunRest.Bytes())
+
+	var moof bytes.Buffer
+	box(&moof, "moof", trun.Bytes())
+	out := moof.Bytes()
+
+	patchDataOffset(out, 0x1234)
+
+	idx := bytes.Index(out, []byte("trun"))
+	got := binary.BigEndian.Uint32(out[idx+12 : idx+16])
+	if got != 0x1234 {
+		t.Errorf("patched data offset = %#x, want %#x", got, 0x1234)
+	}
+}
+
+func TestMoofMdatDuration(t *testing.T) {
+	cases := []struct {
+		name     string
+		duration uint32
+	}{
+		{"video frame interval", 3003},
+		{"audio frame interval", 960},
+		{"zero", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := sample{data: []byte{1, 2, 3}, pts: 12345, keyFrame: true}
+			out := moofMdat(1, fmp4VideoTrackID, c.duration, s)
+
+			idx := bytes.Index(out, []byte("trun"))
+			if idx < 0 {
+				t.Fatal("trun box not found")
+			}
+			// trun payload: version+flags(4) + sample count(4) + data offset(4) + duration(4)
+			got := binary.BigEndian.Uint32(out[idx+16 : idx+20])
+			if got != c.duration {
+				t.Errorf("trun duration = %d, want %d", got, c.duration)
+			}
+
+			if !bytes.Contains(out, []byte("mdat")) {
+				t.Error("mdat box not found")
+			}
+			if !bytes.HasSuffix(out, s.data) {
+				t.Error("mdat payload missing sample data")
+			}
+		})
+	}
+}
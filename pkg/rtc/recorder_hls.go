@@ -0,0 +1,186 @@
+package rtc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// hlsPlaylistWindow is how many segments hlsRecorder keeps in the
+// rolling m3u8 playlist; older segment files stay on disk but drop out
+// of the playlist, the same windowing a live HLS recorder uses.
+const hlsPlaylistWindow = 6
+
+// hlsRecorder writes CMAF-style fMP4 segments (an init.mp4 plus
+// numbered segment files) and a rolling m3u8 playlist, reusing the
+// fMP4 box-writing helpers from recorder_fmp4.go for each segment's
+// contents.
+type hlsRecorder struct {
+	*recorderTracks
+
+	mu              sync.Mutex
+	dir             string
+	segmentDuration time.Duration
+	hasVideo        bool
+
+	cur          *os.File
+	curSeq       uint32
+	curStart     int64
+	curHasSample bool
+	segments     []string
+	closed       bool
+
+	// lastPTS holds each track's previous sample PTS (in that track's own
+	// RTP clock ticks), so writeSample can derive the next trun's
+	// duration from the gap between consecutive samples.
+	lastPTS map[uint32]int64
+}
+
+func newHLSRecorder(cfg RecorderConfig, videoSSRC, audioSSRC uint32) (*hlsRecorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	initFile, err := os.Create(filepath.Join(cfg.Dir, "init.mp4"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := initFile.Write(ftypBox()); err != nil {
+		initFile.Close()
+		return nil, err
+	}
+	if _, err := initFile.Write(moovBox(videoSSRC != 0, audioSSRC != 0, cfg.VideoCodec)); err != nil {
+		initFile.Close()
+		return nil, err
+	}
+	initFile.Close()
+
+	segDur := cfg.SegmentDuration
+	if segDur <= 0 {
+		segDur = 4 * time.Second
+	}
+
+	r := &hlsRecorder{
+		recorderTracks:  newRecorderTracks(),
+		dir:             cfg.Dir,
+		segmentDuration: segDur,
+		hasVideo:        videoSSRC != 0,
+		lastPTS:         make(map[uint32]int64),
+	}
+
+	if videoSSRC != 0 {
+		r.add(videoSSRC, newTrackDepacketizer(cfg.VideoCodec, 90000, &hlsTrackWriter{r: r, trackID: fmp4VideoTrackID, rate: 90000}))
+	}
+	if audioSSRC != 0 {
+		r.add(audioSSRC, newTrackDepacketizer("opus", 48000, &hlsTrackWriter{r: r, trackID: fmp4AudioTrackID, rate: 48000}))
+	}
+	return r, nil
+}
+
+type hlsTrackWriter struct {
+	r       *hlsRecorder
+	trackID uint32
+	rate    uint32 // this track's RTP clock rate; rate/30 is the fallback duration for its first sample
+}
+
+func (w *hlsTrackWriter) writeSample(s sample) error {
+	return w.r.writeSample(w.trackID, w.rate, s)
+}
+
+// writeSample appends s's fragment to the current segment, cutting a new
+// segment first when this is a video keyframe and the current one has
+// already run for at least segmentDuration (or there's no current
+// segment yet). Audio samples never start a new segment on their own;
+// they fall into whatever segment is open.
+func (r *hlsRecorder) writeSample(trackID uint32, rate uint32, s sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return fmt.Errorf("rtc: hlsRecorder: write after Close")
+	}
+
+	isCutPoint := trackID == fmp4VideoTrackID && s.keyFrame
+	if r.cur == nil || (isCutPoint && s.pts-r.curStart >= int64(r.segmentDuration/time.Millisecond)*90) {
+		if err := r.cutSegment(); err != nil {
+			return err
+		}
+		r.curStart = s.pts
+	}
+
+	duration := rate / 30
+	if prev, ok := r.lastPTS[trackID]; ok && s.pts > prev {
+		duration = uint32(s.pts - prev)
+	}
+	r.lastPTS[trackID] = s.pts
+
+	r.curSeq++
+	if _, err := r.cur.Write(moofMdat(r.curSeq, trackID, duration, s)); err != nil {
+		return err
+	}
+	r.curHasSample = true
+	return r.writePlaylist()
+}
+
+func (r *hlsRecorder) cutSegment() error {
+	if r.cur != nil {
+		r.cur.Close()
+	}
+	name := fmt.Sprintf("segment%d.m4s", len(r.segments))
+	f, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+	r.cur = f
+	r.curSeq = 0
+	r.curHasSample = false
+	r.segments = append(r.segments, name)
+	return nil
+}
+
+func (r *hlsRecorder) writePlaylist() error {
+	first := 0
+	if len(r.segments) > hlsPlaylistWindow {
+		first = len(r.segments) - hlsPlaylistWindow
+	}
+	window := r.segments[first:]
+
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(r.segmentDuration.Seconds())+1) +
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", first) +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n"
+	for _, name := range window {
+		playlist += fmt.Sprintf("#EXTINF:%.3f,\n%s\n", r.segmentDuration.Seconds(), name)
+	}
+
+	return os.WriteFile(filepath.Join(r.dir, "playlist.m3u8"), []byte(playlist), 0644)
+}
+
+func (r *hlsRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(r.segmentDuration.Seconds())+1) +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n"
+	for _, name := range r.segments {
+		playlist += fmt.Sprintf("#EXTINF:%.3f,\n%s\n", r.segmentDuration.Seconds(), name)
+	}
+	playlist += "#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(filepath.Join(r.dir, "playlist.m3u8"), []byte(playlist), 0644); err != nil {
+		return err
+	}
+
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package rtc
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Matroska TrackNumber values this recorder writes: 1 is always video
+// (if present), 2 is always audio (if present). The EBML element IDs
+// are in the var block below; Matroska reuses EBML's variable-length
+// integer encoding for both IDs and element sizes.
+const (
+	webmVideoTrackNumber = 1
+	webmAudioTrackNumber = 2
+)
+
+// ebmlVint encodes v as an EBML variable-length "data size" integer:
+// the number of leading zero bits in the first byte plus one gives the
+// total length, and a single marker bit is set right after those zeros.
+func ebmlVint(v uint64) []byte {
+	length := 1
+	for length < 8 && v >= (uint64(1)<<(uint(length)*7))-1 {
+		length++
+	}
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	b[0] |= 1 << uint(8-length)
+	return b
+}
+
+// ebmlElement writes an EBML element: id (already including its own
+// length marker bits, passed as raw bytes), the size vint, then payload.
+func ebmlElement(w *bytes.Buffer, id []byte, payload []byte) {
+	w.Write(id)
+	w.Write(ebmlVint(uint64(len(payload))))
+	w.Write(payload)
+}
+
+func ebmlUint(v uint64) []byte {
+	var buf bytes.Buffer
+	started := false
+	for shift := 56; shift >= 0; shift -= 8 {
+		b := byte(v >> uint(shift))
+		if b != 0 {
+			started = true
+		}
+		if started {
+			buf.WriteByte(b)
+		}
+	}
+	if buf.Len() == 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+var (
+	idEBML        = []byte{0x1A, 0x45, 0xDF, 0xA3}
+	idSegment     = []byte{0x18, 0x53, 0x80, 0x67}
+	idInfo        = []byte{0x15, 0x49, 0xA9, 0x66}
+	idTimecodeS   = []byte{0x2A, 0xD7, 0xB1}
+	idMuxingApp   = []byte{0x4D, 0x80}
+	idWritingApp  = []byte{0x57, 0x41}
+	idTracks      = []byte{0x16, 0x54, 0xAE, 0x6B}
+	idTrackEntry  = []byte{0xAE}
+	idTrackNumber = []byte{0xD7}
+	idTrackUID    = []byte{0x73, 0xC5}
+	idTrackType   = []byte{0x83}
+	idCodecID     = []byte{0x86}
+	idVideo       = []byte{0xE0}
+	idPixelWidth  = []byte{0xB0}
+	idPixelHeight = []byte{0xBA}
+	idAudio       = []byte{0xE1}
+	idSampleFreq  = []byte{0xB5}
+	idChannels    = []byte{0x9F}
+	idCluster     = []byte{0x1F, 0x43, 0xB6, 0x75}
+	idTimecode    = []byte{0xE7}
+	idSimpleBlock = []byte{0xA3}
+)
+
+// ebmlFloat64 returns the IEEE-754 big-endian encoding of v, the form
+// Matroska's SamplingFrequency element uses.
+func ebmlFloat64(v float64) []byte {
+	bits := float64bits(v)
+	b := make([]byte, 8)
+	for i := 7; i >= 0; i-- {
+		b[i] = byte(bits)
+		bits >>= 8
+	}
+	return b
+}
+
+func float64bits(f float64) uint64 {
+	// math.Float64bits without importing math just for this: webm only
+	// ever needs a handful of fixed sample rates here, so a tiny manual
+	// IEEE-754 encode keeps this file's import list minimal.
+	sign := uint64(0)
+	if f < 0 {
+		sign = 1
+		f = -f
+	}
+	if f == 0 {
+		return sign << 63
+	}
+	exp := 1023
+	for f >= 2 {
+		f /= 2
+		exp++
+	}
+	for f < 1 {
+		f *= 2
+		exp--
+	}
+	frac := f - 1
+	mantissa := uint64(frac * (1 << 52))
+	return sign<<63 | uint64(exp)<<52 | mantissa
+}
+
+func webmHeader() []byte {
+	var ebml bytes.Buffer
+	ebmlElement(&ebml, []byte{0x42, 0x86}, ebmlUint(1))    // EBMLVersion
+	ebmlElement(&ebml, []byte{0x42, 0xF7}, ebmlUint(1))    // EBMLReadVersion
+	ebmlElement(&ebml, []byte{0x42, 0xF2}, ebmlUint(4))    // EBMLMaxIDLength
+	ebmlElement(&ebml, []byte{0x42, 0xF3}, ebmlUint(8))    // EBMLMaxSizeLength
+	ebmlElement(&ebml, []byte{0x42, 0x82}, []byte("webm")) // DocType
+	ebmlElement(&ebml, []byte{0x42, 0x87}, ebmlUint(2))    // DocTypeVersion
+	ebmlElement(&ebml, []byte{0x42, 0x85}, ebmlUint(2))    // DocTypeReadVersion
+	var out bytes.Buffer
+	ebmlElement(&out, idEBML, ebml.Bytes())
+	return out.Bytes()
+}
+
+func webmInfo() []byte {
+	var info bytes.Buffer
+	ebmlElement(&info, idTimecodeS, ebmlUint(1000000)) // 1ms ticks
+	ebmlElement(&info, idMuxingApp, []byte("ion"))
+	ebmlElement(&info, idWritingApp, []byte("ion"))
+	var out bytes.Buffer
+	ebmlElement(&out, idInfo, info.Bytes())
+	return out.Bytes()
+}
+
+func webmTracks(hasVideo, hasAudio bool, videoCodec string) []byte {
+	var tracks bytes.Buffer
+	if hasVideo {
+		codecID := "V_VP8"
+		if videoCodec == "vp9" {
+			codecID = "V_VP9"
+		}
+		var entry bytes.Buffer
+		ebmlElement(&entry, idTrackNumber, ebmlUint(webmVideoTrackNumber))
+		ebmlElement(&entry, idTrackUID, ebmlUint(webmVideoTrackNumber))
+		ebmlElement(&entry, idTrackType, ebmlUint(1)) // video
+		ebmlElement(&entry, idCodecID, []byte(codecID))
+		var video bytes.Buffer
+		ebmlElement(&video, idPixelWidth, ebmlUint(1280))
+		ebmlElement(&video, idPixelHeight, ebmlUint(720))
+		ebmlElement(&entry, idVideo, video.Bytes())
+		ebmlElement(&tracks, idTrackEntry, entry.Bytes())
+	}
+	if hasAudio {
+		var entry bytes.Buffer
+		ebmlElement(&entry, idTrackNumber, ebmlUint(webmAudioTrackNumber))
+		ebmlElement(&entry, idTrackUID, ebmlUint(webmAudioTrackNumber))
+		ebmlElement(&entry, idTrackType, ebmlUint(2)) // audio
+		ebmlElement(&entry, idCodecID, []byte("A_OPUS"))
+		var audio bytes.Buffer
+		ebmlElement(&audio, idSampleFreq, ebmlFloat64(48000))
+		ebmlElement(&audio, idChannels, ebmlUint(2))
+		ebmlElement(&entry, idAudio, audio.Bytes())
+		ebmlElement(&tracks, idTrackEntry, entry.Bytes())
+	}
+	var out bytes.Buffer
+	ebmlElement(&out, idTracks, tracks.Bytes())
+	return out.Bytes()
+}
+
+// clusterWithBlock writes a Cluster containing a single SimpleBlock. Like
+// the fMP4 recorder, webmRecorder keeps clustering simple by giving every
+// sample its own cluster rather than batching several samples per
+// cluster before the next keyframe.
+func clusterWithBlock(trackNumber uint64, timecodeMS int64, keyFrame bool, data []byte) []byte {
+	var cluster bytes.Buffer
+	ebmlElement(&cluster, idTimecode, ebmlUint(uint64(timecodeMS)))
+
+	var block bytes.Buffer
+	block.Write(ebmlVint(trackNumber))
+	block.Write([]byte{0x00, 0x00}) // relative timecode within the cluster
+	flags := byte(0)
+	if keyFrame {
+		flags |= 0x80
+	}
+	block.WriteByte(flags)
+	block.Write(data)
+	ebmlElement(&cluster, idSimpleBlock, block.Bytes())
+
+	var out bytes.Buffer
+	ebmlElement(&out, idCluster, cluster.Bytes())
+	return out.Bytes()
+}
+
+// webmRecorder writes a single Matroska/WebM file containing a VP8/VP9
+// video track and/or an Opus audio track.
+type webmRecorder struct {
+	*recorderTracks
+
+	mu     sync.Mutex
+	f      *os.File
+	closed bool
+}
+
+func newWebMRecorder(cfg RecorderConfig, videoSSRC, audioSSRC uint32) (*webmRecorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(cfg.Dir, "record.webm"))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &webmRecorder{recorderTracks: newRecorderTracks(), f: f}
+
+	var out bytes.Buffer
+	out.Write(webmHeader())
+	var segment bytes.Buffer
+	segment.Write(webmInfo())
+	segment.Write(webmTracks(videoSSRC != 0, audioSSRC != 0, cfg.VideoCodec))
+	// Segment's size is left unknown (all-ones vint) since clusters are
+	// appended incrementally as samples arrive.
+	out.Write(idSegment)
+	out.Write([]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	out.Write(segment.Bytes())
+	if _, err := f.Write(out.Bytes()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if videoSSRC != 0 {
+		r.add(videoSSRC, newTrackDepacketizer(cfg.VideoCodec, 90000, &webmTrackWriter{r: r, trackNumber: webmVideoTrackNumber, rate: 90000}))
+	}
+	if audioSSRC != 0 {
+		r.add(audioSSRC, newTrackDepacketizer("opus", 48000, &webmTrackWriter{r: r, trackNumber: webmAudioTrackNumber, rate: 48000}))
+	}
+	return r, nil
+}
+
+type webmTrackWriter struct {
+	r           *webmRecorder
+	trackNumber uint64
+	rate        uint32 // this track's RTP clock rate, for converting pts to Matroska's 1ms ticks
+}
+
+func (w *webmTrackWriter) writeSample(s sample) error {
+	return w.r.writeCluster(w.trackNumber, w.rate, s)
+}
+
+func (r *webmRecorder) writeCluster(trackNumber uint64, rate uint32, s sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return fmt.Errorf("rtc: webmRecorder: write after Close")
+	}
+	timecodeMS := s.pts / int64(rate/1000)
+	_, err := r.f.Write(clusterWithBlock(trackNumber, timecodeMS, s.keyFrame, s.data))
+	return err
+}
+
+func (r *webmRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.f.Close()
+}
@@ -0,0 +1,159 @@
+package rtc
+
+import (
+	"sync"
+
+	"github.com/pion/ion/pkg/log"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// ridExtensionURI and repairedRidExtensionURI are the header extensions
+	// a simulcast publisher uses to mark which encoding ("rid") and, for a
+	// repair stream, which encoding it repairs.
+	ridExtensionURI         = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	repairedRidExtensionURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+
+	// simulcastLayer* are the rid values ion expects a simulcast publisher
+	// to use, low to high quality.
+	simulcastLayerLow    = "q"
+	simulcastLayerMedium = "h"
+	simulcastLayerHigh   = "f"
+
+	// layerSwitch*BW are the REMB/TargetBitrate thresholds (bytes/sec)
+	// below which a subscriber is stepped down to the next lower layer.
+	layerSwitchLowBW    = 100 * 1000
+	layerSwitchMediumBW = 300 * 1000
+)
+
+// downTrackRewriter keeps a subscriber's outbound sequence numbers and RTP
+// timestamps monotonic and contiguous across a simulcast layer switch, by
+// remembering the gap introduced each time the forwarded layer changes.
+type downTrackRewriter struct {
+	mu sync.Mutex
+
+	init          bool
+	layer         string
+	seqOffset     uint16
+	tsOffset      uint32
+	lastSeqno     uint16
+	lastTimestamp uint32
+}
+
+// rewrite adjusts pkt in place so that, from the subscriber's point of
+// view, it is the next packet after whatever was last forwarded - even if
+// it actually came from a different simulcast layer.
+func (r *downTrackRewriter) rewrite(pkt *rtp.Packet, layer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.init {
+		r.seqOffset = 0
+		r.tsOffset = 0
+	} else if layer != r.layer {
+		r.seqOffset = pkt.SequenceNumber - r.lastSeqno - 1
+		r.tsOffset = pkt.Timestamp - r.lastTimestamp
+	}
+	r.init = true
+	r.layer = layer
+
+	pkt.SequenceNumber -= r.seqOffset
+	pkt.Timestamp -= r.tsOffset
+
+	r.lastSeqno = pkt.SequenceNumber
+	r.lastTimestamp = pkt.Timestamp
+}
+
+// storeUpTrack remembers a publisher's simulcast encoding so a subscriber
+// can later pick which layer to receive. rid is "" for a non-simulcast
+// publish, where there is only ever one layer.
+func (t *WebRTCTransport) storeUpTrack(rid string, track *webrtc.Track) {
+	t.upTracksLock.Lock()
+	t.upTracks[rid] = track
+	t.upTracksLock.Unlock()
+}
+
+// UpTrack returns the remote track published for a given simulcast layer.
+func (t *WebRTCTransport) UpTrack(rid string) (*webrtc.Track, bool) {
+	t.upTracksLock.RLock()
+	defer t.upTracksLock.RUnlock()
+	track, ok := t.upTracks[rid]
+	return track, ok
+}
+
+// layerForSSRC returns the rid of the upTrack publishing ssrc, the inverse
+// of storeUpTrack's rid->track mapping. It is how a caller resending a
+// cached packet (keyed only by SSRC) recovers the layer to pass to
+// forwardFor/WriteRTP.
+func (t *WebRTCTransport) layerForSSRC(ssrc uint32) string {
+	t.upTracksLock.RLock()
+	defer t.upTracksLock.RUnlock()
+	for rid, track := range t.upTracks {
+		if track.SSRC() == ssrc {
+			return rid
+		}
+	}
+	return ""
+}
+
+// SelectLayer sets the simulcast layer ("q", "h" or "f") this subscriber
+// wants forwarded. It takes effect on the next packet handed to
+// forwardFor.
+func (t *WebRTCTransport) SelectLayer(layer string) {
+	t.targetLayerLock.Lock()
+	t.targetLayer = layer
+	t.targetLayerLock.Unlock()
+}
+
+// TargetLayer returns the simulcast layer this subscriber currently wants,
+// defaulting to the highest quality layer.
+func (t *WebRTCTransport) TargetLayer() string {
+	t.targetLayerLock.RLock()
+	defer t.targetLayerLock.RUnlock()
+	if t.targetLayer == "" {
+		return simulcastLayerHigh
+	}
+	return t.targetLayer
+}
+
+// forwardFor reports whether a packet from the given simulcast layer
+// should be forwarded to this subscriber and, if so, rewrites its
+// sequence number/timestamp to stay contiguous with whatever layer was
+// forwarded before. layer is "" for a non-simulcast publish, which always
+// forwards.
+func (t *WebRTCTransport) forwardFor(ssrc uint32, layer string, pkt *rtp.Packet) bool {
+	if layer != "" && layer != t.TargetLayer() {
+		return false
+	}
+
+	t.downRewritersLock.Lock()
+	rw, ok := t.downRewriters[ssrc]
+	if !ok {
+		rw = &downTrackRewriter{}
+		t.downRewriters[ssrc] = rw
+	}
+	t.downRewritersLock.Unlock()
+
+	rw.rewrite(pkt, layer)
+	return true
+}
+
+// maybeSwitchLayer adjusts the subscriber's target simulcast layer to fit
+// an available bitrate reported via REMB or the GCC bandwidth estimator.
+func (t *WebRTCTransport) maybeSwitchLayer(bitrate uint64) {
+	var layer string
+	switch {
+	case bitrate < layerSwitchLowBW:
+		layer = simulcastLayerLow
+	case bitrate < layerSwitchMediumBW:
+		layer = simulcastLayerMedium
+	default:
+		layer = simulcastLayerHigh
+	}
+
+	if layer != t.TargetLayer() {
+		log.Infof("WebRTCTransport.maybeSwitchLayer id=%v layer=%v bitrate=%v", t.id, layer, bitrate)
+		t.SelectLayer(layer)
+	}
+}
@@ -15,9 +15,6 @@ import (
 )
 
 const (
-	// for pli
-	pliDuration = 1 * time.Second
-
 	// for remb
 	rembDuration = 3 * time.Second
 	rembLowBW    = 30 * 1000
@@ -45,12 +42,20 @@ func initICE(ices []string) {
 
 // WebRTCTransport ..
 type WebRTCTransport struct {
-	id           string
-	pc           *webrtc.PeerConnection
-	track        map[uint32]*webrtc.Track
-	trackLock    sync.RWMutex
+	id        string
+	pc        *webrtc.PeerConnection
+	track     map[uint32]*webrtc.Track
+	trackLock sync.RWMutex
+	// videoSSRC and audioSSRC are this subscriber's own stable local track
+	// SSRCs (0 if that kind wasn't subscribed). A publish's simulcast
+	// layers each arrive on their own upstream SSRC, but a subscriber only
+	// ever negotiates one video track and one audio track; forwardFor and
+	// WriteRTP key off these, not the upstream SSRC a packet happens to
+	// carry, so forwarding the same subscriber track across a layer switch
+	// stays keyed to the one rewriter/track that track actually has.
+	videoSSRC    uint32
+	audioSSRC    uint32
 	stopCh       chan struct{}
-	pliCh        chan int
 	rtpCh        chan *rtp.Packet
 	wg           sync.WaitGroup
 	ssrcPT       map[uint32]uint8
@@ -61,16 +66,75 @@ type WebRTCTransport struct {
 	hasAudio     bool
 	hasScreen    bool
 	errCount     int
+
+	// pubCache holds a packetCache per published SSRC so subscriber NACKs
+	// can be answered without round-tripping to the original publisher.
+	pubCache     map[uint32]*packetCache
+	pubCacheLock sync.RWMutex
+
+	// upTracks holds a publisher's simulcast encodings, keyed by rid ("" if
+	// the publish isn't simulcast).
+	upTracks     map[string]*webrtc.Track
+	upTracksLock sync.RWMutex
+
+	// targetLayer is the simulcast layer a subscriber wants forwarded.
+	targetLayer     string
+	targetLayerLock sync.RWMutex
+
+	// downRewriters keeps outbound seqno/timestamp state per local track
+	// SSRC (see localTrack) so a subscriber's track stays monotonic across
+	// a layer switch, rather than per upstream/per-layer SSRC - the whole
+	// point of a rewriter is to bridge the gap between two layers' worth
+	// of sequence numbers for the one track that keeps forwarding.
+	downRewriters     map[uint32]*downTrackRewriter
+	downRewritersLock sync.RWMutex
+
+	// tccExtID and tccRecv drive the receive side of transport-cc: when a
+	// publish negotiates the header extension, every inbound packet's
+	// transport-wide sequence number is recorded and reported back to
+	// the publisher every gccFeedbackInterval.
+	tccExtID uint8
+	tccRecv  *twccFeedbackGenerator
+
+	// tccSendExtID, tccSendSeq and tccSendHistory drive the send side:
+	// when a subscribe negotiates the extension, every outbound packet
+	// is tagged with the next transport-wide sequence number and its
+	// send time recorded so returning feedback can be matched back up.
+	tccSendExtID   uint8
+	tccSendSeq     uint16
+	tccSendSeqLock sync.Mutex
+	tccSendHistory *twccSendHistory
+
+	// bwe and targetBitrate hold the GCC bandwidth estimate computed
+	// from transport-cc feedback a subscriber sends back; maybeSwitchLayer
+	// and sendREMB both consume it via TargetBitrate.
+	bwe               *gccBandwidthEstimator
+	targetBitrate     uint64
+	targetBitrateLock sync.RWMutex
+
+	// recorder, if set via Record, observes every packet receiveRTP hands
+	// to subscribers and writes it to disk.
+	recorder     Recorder
+	recorderLock sync.RWMutex
+
+	// pli drives the event-driven keyframe requester: per-SSRC rate
+	// limiting, PLI/FIR escalation state and keyframe sniffing, used by
+	// RequestKeyFrame.
+	pli     *pliRequester
+	pliLock sync.Mutex
 }
 
 func newWebRTCTransport(id string) *WebRTCTransport {
 	w := &WebRTCTransport{
-		id:     id,
-		track:  make(map[uint32]*webrtc.Track),
-		stopCh: make(chan struct{}),
-		pliCh:  make(chan int),
-		rtpCh:  make(chan *rtp.Packet, 1000),
-		ssrcPT: make(map[uint32]uint8),
+		id:       id,
+		track:    make(map[uint32]*webrtc.Track),
+		stopCh:   make(chan struct{}),
+		rtpCh:    make(chan *rtp.Packet, 1000),
+		ssrcPT:   make(map[uint32]uint8),
+		pubCache: make(map[uint32]*packetCache),
+
+		upTracks:      make(map[string]*webrtc.Track),
+		downRewriters: make(map[uint32]*downTrackRewriter),
 	}
 
 	return w
@@ -101,6 +165,13 @@ func (t *WebRTCTransport) AnswerPublish(rid string, offer webrtc.SessionDescript
 		}
 	}
 
+	// pion/webrtc/v2's MediaEngine has no header-extension registration API,
+	// so the rid/repaired-rid and transport-cc extensions aren't declared
+	// here; ridExtID below and extmapID elsewhere read their negotiated ids
+	// straight off the offer SDP, the same as transportCCExtensionURI, and
+	// rtp.Packet parses/writes them by id without needing registration.
+	ridExtID := extmapID(offer.SDP, ridExtensionURI)
+
 	//check video audio screen
 	if v, ok := options["video"].(bool); ok {
 		t.hasVideo = v
@@ -134,27 +205,27 @@ func (t *WebRTCTransport) AnswerPublish(rid string, offer webrtc.SessionDescript
 		t.ssrcPTLock.Lock()
 		t.ssrcPT[remoteTrack.SSRC()] = remoteTrack.PayloadType()
 		t.ssrcPTLock.Unlock()
+		if ridExtID == 0 {
+			// Not a simulcast publish (no rid extension negotiated), so
+			// there's only ever one layer and nothing to wait on a packet
+			// for; receiveRTP stores the rest once it sees one, keyed by
+			// whatever rid its packets carry.
+			t.storeUpTrack("", remoteTrack)
+		}
 		if remoteTrack.PayloadType() == webrtc.DefaultPayloadTypeVP8 ||
 			remoteTrack.PayloadType() == webrtc.DefaultPayloadTypeVP9 ||
 			remoteTrack.PayloadType() == webrtc.DefaultPayloadTypeH264 {
-			t.wg.Add(1)
-			go func() {
-				for {
-					select {
-					case <-t.pliCh:
-						log.Debugf("WebRTCTransport.AnswerPublish WriteRTCP PLI %v", remoteTrack.SSRC())
-						t.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{SenderSSRC: remoteTrack.SSRC(), MediaSSRC: remoteTrack.SSRC()}})
-					case <-t.stopCh:
-						t.wg.Done()
-						return
-					}
-				}
-			}()
+			// Request an initial keyframe as soon as the track starts
+			// flowing, so the first subscriber has a decodable start;
+			// RequestKeyFrame is also what new subscribers, packet-cache
+			// gap detection and relayed subscriber PLIs call into from
+			// here on, replacing the old fixed-interval ticker.
+			t.RequestKeyFrame(remoteTrack.SSRC())
 			fn(remoteTrack.SSRC(), remoteTrack.PayloadType())
-			t.receiveRTP(remoteTrack)
+			t.receiveRTP(remoteTrack, ridExtID)
 		} else {
 			fn(remoteTrack.SSRC(), remoteTrack.PayloadType())
-			t.receiveRTP(remoteTrack)
+			t.receiveRTP(remoteTrack, ridExtID)
 		}
 	})
 
@@ -163,17 +234,32 @@ func (t *WebRTCTransport) AnswerPublish(rid string, offer webrtc.SessionDescript
 		return webrtc.SessionDescription{}, err
 	}
 
+	if id := extmapID(offer.SDP, transportCCExtensionURI); id != 0 {
+		t.tccExtID = id
+		t.tccRecv = newTWCCFeedbackGenerator()
+		t.sendTWCCFeedback()
+	}
+
 	answer, err = t.pc.CreateAnswer(nil)
 	err = t.pc.SetLocalDescription(answer)
 	//TODO recently not use, fix panic?
 	// t.pubReceiveRTCP()
 
-	t.sendPLI()
 	return answer, err
 }
 
-func (t *WebRTCTransport) AnswerSubscribe(offer webrtc.SessionDescription, ssrcPT map[uint32]uint8, mid string) (answer webrtc.SessionDescription, err error) {
+// AnswerSubscribe answers a subscribe offer. options may carry a "layer"
+// entry ("q", "h" or "f") naming the simulcast layer this subscriber wants
+// forwarded; it is ignored for a non-simulcast publish.
+func (t *WebRTCTransport) AnswerSubscribe(offer webrtc.SessionDescription, ssrcPT map[uint32]uint8, mid string, options map[string]interface{}) (answer webrtc.SessionDescription, err error) {
+	if layer, ok := options["layer"].(string); ok {
+		t.SelectLayer(layer)
+	}
 
+	// As in AnswerPublish, pion/webrtc/v2's MediaEngine has no
+	// header-extension registration API; extmapID below reads the
+	// transport-cc extension's negotiated id straight off the offer SDP
+	// instead, and tagTWCC/setTWCCExtension write it by id directly.
 	mediaEngine := webrtc.MediaEngine{}
 	mediaEngine.RegisterDefaultCodecs()
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
@@ -182,19 +268,40 @@ func (t *WebRTCTransport) AnswerSubscribe(offer webrtc.SessionDescription, ssrcP
 		return webrtc.SessionDescription{}, err
 	}
 
-	var track *webrtc.Track
+	// ssrcPT carries one entry per upstream SSRC, which for a simulcast
+	// publish means one per layer (q/h/f) all sharing the same payload
+	// type. A subscriber still only gets one video track and one audio
+	// track; which layer feeds it is decided later per-packet by
+	// forwardFor, not by negotiating a track per layer. So only the first
+	// SSRC seen for each kind is used to create that kind's local track.
+	var videoSSRC, audioSSRC uint32
+	var videoPT, audioPT uint8
 	for ssrc, pt := range ssrcPT {
 		if pt == webrtc.DefaultPayloadTypeVP8 ||
 			pt == webrtc.DefaultPayloadTypeVP9 ||
 			pt == webrtc.DefaultPayloadTypeH264 {
-			track, _ = t.pc.NewTrack(pt, ssrc, "video", "pion")
-		} else {
-			track, _ = t.pc.NewTrack(pt, ssrc, "audio", "pion")
+			if videoSSRC == 0 {
+				videoSSRC, videoPT = ssrc, pt
+			}
+		} else if audioSSRC == 0 {
+			audioSSRC, audioPT = ssrc, pt
 		}
-		if track != nil {
+	}
+	if videoSSRC != 0 {
+		if track, _ := t.pc.NewTrack(videoPT, videoSSRC, "video", "pion"); track != nil {
 			t.pc.AddTrack(track)
+			t.videoSSRC = videoSSRC
 			t.trackLock.Lock()
-			t.track[ssrc] = track
+			t.track[videoSSRC] = track
+			t.trackLock.Unlock()
+		}
+	}
+	if audioSSRC != 0 {
+		if track, _ := t.pc.NewTrack(audioPT, audioSSRC, "audio", "pion"); track != nil {
+			t.pc.AddTrack(track)
+			t.audioSSRC = audioSSRC
+			t.trackLock.Lock()
+			t.track[audioSSRC] = track
 			t.trackLock.Unlock()
 		}
 	}
@@ -204,36 +311,76 @@ func (t *WebRTCTransport) AnswerSubscribe(offer webrtc.SessionDescription, ssrcP
 		return webrtc.SessionDescription{}, err
 	}
 
+	if id := extmapID(offer.SDP, transportCCExtensionURI); id != 0 {
+		t.tccSendExtID = id
+		t.tccSendHistory = newTWCCSendHistory()
+		t.bwe = newGCCBandwidthEstimator()
+	}
+
 	answer, err = t.pc.CreateAnswer(nil)
 	err = t.pc.SetLocalDescription(answer)
 	t.subReadRTCP(mid)
+
+	// A new subscriber needs a decodable start; ask the publisher for a
+	// fresh keyframe rather than waiting for the next one in the GOP.
+	for ssrc, pt := range ssrcPT {
+		if pt == webrtc.DefaultPayloadTypeVP8 ||
+			pt == webrtc.DefaultPayloadTypeVP9 ||
+			pt == webrtc.DefaultPayloadTypeH264 {
+			getPipeline(mid).getPub().RequestKeyFrame(ssrc)
+		}
+	}
 	return answer, err
 }
 
-func (t *WebRTCTransport) sendPLI() {
-	if t.hasVideo || t.hasScreen {
-		go func() {
-			ticker := time.NewTicker(pliDuration)
-			defer ticker.Stop()
-			t.wg.Add(1)
-			for {
-				select {
-				case <-ticker.C:
-					t.pliCh <- 1
-				case <-t.stopCh:
-					t.wg.Done()
-					return
+// sendTWCCFeedback periodically reports accumulated packet arrivals back
+// to the publisher as rtcp.TransportLayerCC, once transport-cc has been
+// negotiated for this publish.
+func (t *WebRTCTransport) sendTWCCFeedback() {
+	go func() {
+		ticker := time.NewTicker(gccFeedbackInterval)
+		defer ticker.Stop()
+		t.wg.Add(1)
+		for {
+			select {
+			case <-ticker.C:
+				t.ssrcPTLock.RLock()
+				var mediaSSRC uint32
+				for ssrc, pt := range t.ssrcPT {
+					// Prefer the video SSRC so a publish with both audio and
+					// video picks it deterministically rather than whichever
+					// map iteration happened to land last; fall back to
+					// whatever SSRC is there for an audio-only publish.
+					if mediaSSRC == 0 || pt == webrtc.DefaultPayloadTypeVP8 ||
+						pt == webrtc.DefaultPayloadTypeVP9 ||
+						pt == webrtc.DefaultPayloadTypeH264 {
+						mediaSSRC = ssrc
+					}
+				}
+				t.ssrcPTLock.RUnlock()
+
+				if fb := t.tccRecv.build(mediaSSRC, mediaSSRC); fb != nil {
+					t.pc.WriteRTCP([]rtcp.Packet{fb})
 				}
+			case <-t.stopCh:
+				t.wg.Done()
+				return
 			}
-		}()
-	}
+		}
+	}()
 }
 
-func (t *WebRTCTransport) receiveRTP(remoteTrack *webrtc.Track) {
+// receiveRTP reads remoteTrack's packets until it closes. ridExtID is the
+// rid header extension's negotiated id (0 if this publish isn't
+// simulcast); once the first packet carrying it arrives, that rid is
+// recorded as remoteTrack's simulcast layer via storeUpTrack; v2's
+// *webrtc.Track has no RID() of its own to read it from directly.
+func (t *WebRTCTransport) receiveRTP(remoteTrack *webrtc.Track, ridExtID uint8) {
 	t.wg.Add(1)
 	ticker := time.NewTicker(3 * time.Second)
 	defer ticker.Stop()
 	total := uint64(0)
+	haveRID := ridExtID == 0
 	for {
 		select {
 		case <-t.stopCh:
@@ -252,7 +399,28 @@ func (t *WebRTCTransport) receiveRTP(remoteTrack *webrtc.Track) {
 				}
 				log.Errorf("rtp err => %v", err)
 			}
+			if !haveRID {
+				if payload := rtp.GetExtension(ridExtID); payload != nil {
+					t.storeUpTrack(string(payload), remoteTrack)
+					haveRID = true
+				}
+			}
 			total += uint64(rtp.MarshalSize())
+			t.cachePacket(rtp)
+			t.observeKeyFrameSniffing(rtp)
+			if t.tccExtID != 0 {
+				if seq, ok := twccSeq(rtp, t.tccExtID); ok {
+					t.tccRecv.onPacket(seq, time.Now())
+				}
+			}
+			t.recorderLock.RLock()
+			rec := t.recorder
+			t.recorderLock.RUnlock()
+			if rec != nil {
+				if err := rec.WriteRTP(rtp); err != nil {
+					log.Errorf("WebRTCTransport.receiveRTP recorder err=%v", err)
+				}
+			}
 			t.rtpCh <- rtp
 		}
 	}
@@ -267,20 +435,120 @@ func (t *WebRTCTransport) ReadRTP() (*rtp.Packet, error) {
 	return rtp, nil
 }
 
-// WriteRTP send rtp packet
-func (t *WebRTCTransport) WriteRTP(pkt *rtp.Packet) error {
+// localTrack returns this subscriber's own track for pt's media kind
+// (video or audio), regardless of which upstream SSRC a packet of that
+// kind happens to carry - a subscriber only ever has the one of each.
+func (t *WebRTCTransport) localTrack(pt uint8) *webrtc.Track {
+	t.trackLock.RLock()
+	defer t.trackLock.RUnlock()
+	if pt == webrtc.DefaultPayloadTypeVP8 ||
+		pt == webrtc.DefaultPayloadTypeVP9 ||
+		pt == webrtc.DefaultPayloadTypeH264 {
+		return t.track[t.videoSSRC]
+	}
+	return t.track[t.audioSSRC]
+}
+
+// WriteRTP sends pkt to this subscriber, having come from the publisher's
+// given simulcast layer ("" for a non-simulcast publish). forwardFor gates
+// and rewrites pkt so only the layer this subscriber currently wants goes
+// out, with its sequence number/timestamp kept contiguous across a layer
+// switch; a packet from any other layer is silently dropped. The local
+// track is looked up by pkt's media kind rather than its (upstream, per-
+// layer) SSRC, and pkt.SSRC is rewritten to that local track's own SSRC
+// before it's written out, since WriteRTP itself sends pkt.Header as-is.
+func (t *WebRTCTransport) WriteRTP(pkt *rtp.Packet, layer string) error {
 	if pkt == nil {
 		return errInvalidPacket
 	}
-	t.trackLock.RLock()
-	track := t.track[pkt.SSRC]
-	t.trackLock.RUnlock()
-	if track != nil {
-		log.Debugf("WebRTCTransport.WriteRTP pkt=%v", pkt)
-		return track.WriteRTP(pkt)
+	track := t.localTrack(pkt.PayloadType)
+	if track == nil {
+		log.Errorf("WebRTCTransport.WriteRTP track==nil pkt.SSRC=%d", pkt.SSRC)
+		return errInvalidTrack
 	}
-	log.Errorf("WebRTCTransport.WriteRTP track==nil pkt.SSRC=%d", pkt.SSRC)
-	return errInvalidTrack
+	localSSRC := track.SSRC()
+	if !t.forwardFor(localSSRC, layer, pkt) {
+		return nil
+	}
+	pkt.SSRC = localSSRC
+	if t.tccSendExtID != 0 {
+		t.tagTWCC(pkt)
+	}
+	log.Debugf("WebRTCTransport.WriteRTP pkt=%v", pkt)
+	return track.WriteRTP(pkt)
+}
+
+// tagTWCC stamps pkt with the next transport-wide sequence number for this
+// subscriber and records its send time so a later feedback report can be
+// matched back up to it.
+func (t *WebRTCTransport) tagTWCC(pkt *rtp.Packet) {
+	t.tccSendSeqLock.Lock()
+	seq := t.tccSendSeq
+	t.tccSendSeq++
+	t.tccSendSeqLock.Unlock()
+
+	setTWCCExtension(pkt, t.tccSendExtID, seq)
+	t.tccSendHistory.record(seq, time.Now())
+}
+
+// processTWCCFeedback walks a TransportLayerCC report from a subscriber,
+// matching each reported sequence number back to the send time tagTWCC
+// recorded, and feeds the resulting (send, arrival) pairs and loss ratio
+// into the bandwidth estimator. The updated estimate is then used to
+// pick this subscriber's simulcast layer the same way a REMB would.
+func (t *WebRTCTransport) processTWCCFeedback(fb *rtcp.TransportLayerCC) {
+	if t.bwe == nil {
+		return
+	}
+
+	seq := fb.BaseSequenceNumber
+	deltaIdx := 0
+	arrival := time.Unix(0, int64(fb.ReferenceTime)*int64(64*time.Millisecond))
+	lost, total := 0, 0
+	for _, chunk := range fb.PacketChunks {
+		rl, ok := chunk.(*rtcp.RunLengthChunk)
+		if !ok {
+			continue
+		}
+		for i := uint16(0); i < rl.RunLength; i++ {
+			total++
+			if rl.PacketStatusSymbol == rtcp.TypeTCCPacketNotReceived {
+				lost++
+				seq++
+				continue
+			}
+			if deltaIdx < len(fb.RecvDeltas) {
+				arrival = arrival.Add(time.Duration(fb.RecvDeltas[deltaIdx].Delta) * time.Microsecond)
+				deltaIdx++
+			}
+			if sendTime, ok := t.tccSendHistory.take(seq); ok {
+				t.bwe.updateDelay(sendTime, arrival)
+			}
+			seq++
+		}
+	}
+
+	t.bwe.applyDelayEstimate()
+
+	if total > 0 {
+		t.bwe.updateLoss(float64(lost)/float64(total), t.TargetBitrate())
+	}
+
+	bw := t.bwe.target()
+	t.targetBitrateLock.Lock()
+	t.targetBitrate = bw
+	t.targetBitrateLock.Unlock()
+
+	t.maybeSwitchLayer(bw)
+}
+
+// TargetBitrate returns this subscriber's current GCC bandwidth estimate
+// in bytes/sec, or 0 if transport-cc isn't active (the subscriber never
+// offered the extension), in which case callers should fall back to REMB.
+func (t *WebRTCTransport) TargetBitrate() uint64 {
+	t.targetBitrateLock.RLock()
+	defer t.targetBitrateLock.RUnlock()
+	return t.targetBitrate
 }
 
 // Close all
@@ -292,7 +560,7 @@ func (t *WebRTCTransport) Close() {
 	close(t.stopCh)
 	t.wg.Wait()
 	close(t.rtpCh)
-	close(t.pliCh)
+	t.closeRecorder()
 }
 
 // not used
@@ -380,7 +648,9 @@ func (t *WebRTCTransport) subReadRTCP(mid string) {
 					for i := 0; i < len(pkt); i++ {
 						switch pkt[i].(type) {
 						case *rtcp.PictureLossIndication:
-							// pub is already sending PLI now
+							pli := pkt[i].(*rtcp.PictureLossIndication)
+							log.Debugf("WebRTCTransport.subReadRTCP relay PLI mediaSSRC=%v", pli.MediaSSRC)
+							getPipeline(mid).getPub().RequestKeyFrame(pli.MediaSSRC)
 						case *rtcp.TransportLayerNack:
 							log.Debugf("rtcp.TransportLayerNack pkt[i]=%v", pkt[i])
 							nack := pkt[i].(*rtcp.TransportLayerNack)
@@ -388,6 +658,12 @@ func (t *WebRTCTransport) subReadRTCP(mid string) {
 								sns := nackPair.PacketList()
 								for _, sn := range sns {
 									if !getPipeline(mid).writePacket(t.id, nack.MediaSSRC, sn) {
+										pub := getPipeline(mid).getPub()
+										if pkt, ok := pub.getCachedPacket(nack.MediaSSRC, sn); ok {
+											log.Debugf("WebRTCTransport.subReadRTCP resend from cache ssrc=%v sn=%v", nack.MediaSSRC, sn)
+											t.WriteRTP(pkt, pub.layerForSSRC(nack.MediaSSRC))
+											continue
+										}
 										n := &rtcp.TransportLayerNack{
 											//origin ssrc
 											SenderSSRC: nack.SenderSSRC,
@@ -395,11 +671,20 @@ func (t *WebRTCTransport) subReadRTCP(mid string) {
 											Nacks:      []rtcp.NackPair{rtcp.NackPair{PacketID: sn}},
 										}
 										log.Debugf("sendNack to pub %v", n)
-										getPipeline(mid).getPub().sendNack(n)
+										pub.sendNack(n)
 									}
 								}
 							}
 						case *rtcp.ReceiverEstimatedMaximumBitrate:
+							// transport-cc feedback, handled below, is the
+							// more accurate signal; only fall back to REMB
+							// when this subscriber never negotiated it.
+							if t.bwe == nil {
+								remb := pkt[i].(*rtcp.ReceiverEstimatedMaximumBitrate)
+								t.maybeSwitchLayer(uint64(remb.Bitrate) / 8)
+							}
+						case *rtcp.TransportLayerCC:
+							t.processTWCCFeedback(pkt[i].(*rtcp.TransportLayerCC))
 						case *rtcp.ReceiverReport:
 						default:
 							log.Debugf("WebRTCTransport.subReceiveRTCP rtcp type = %v", pkt[i])
@@ -411,6 +696,55 @@ func (t *WebRTCTransport) subReadRTCP(mid string) {
 	}
 }
 
+// cachePacket stores pkt in the ring cache for its SSRC so it can later be
+// resent directly in response to a subscriber NACK. If the packet arrived
+// after a gap too large for this cache to ever answer a NACK for, that is
+// an unrecoverable loss in the reference layer, so a keyframe is
+// requested rather than waiting for the next NACK round-trip to fail.
+func (t *WebRTCTransport) cachePacket(pkt *rtp.Packet) {
+	t.pubCacheLock.Lock()
+	c, ok := t.pubCache[pkt.SSRC]
+	if !ok {
+		c = newPacketCache()
+		t.pubCache[pkt.SSRC] = c
+	}
+	t.pubCacheLock.Unlock()
+
+	gap, err := c.Push(pkt)
+	if err != nil {
+		log.Errorf("WebRTCTransport.cachePacket err=%v", err)
+		return
+	}
+	if gap {
+		log.Debugf("WebRTCTransport.cachePacket unrecoverable gap ssrc=%v sn=%v", pkt.SSRC, pkt.SequenceNumber)
+		t.RequestKeyFrame(pkt.SSRC)
+	}
+}
+
+// getCachedPacket looks up a previously published packet by SSRC and
+// sequence number, for answering a subscriber NACK without forwarding it
+// upstream.
+func (t *WebRTCTransport) getCachedPacket(ssrc uint32, sn uint16) (*rtp.Packet, bool) {
+	t.pubCacheLock.RLock()
+	c, ok := t.pubCache[ssrc]
+	t.pubCacheLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, ok := c.Get(sn)
+	if !ok {
+		return nil, false
+	}
+
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(data); err != nil {
+		log.Errorf("WebRTCTransport.getCachedPacket unmarshal err=%v", err)
+		return nil, false
+	}
+	return pkt, true
+}
+
 // SSRCPT get SSRC and PayloadType
 func (t *WebRTCTransport) SSRCPT() map[uint32]uint8 {
 	t.ssrcPTLock.RLock()
@@ -441,21 +775,29 @@ func (t *WebRTCTransport) sendREMB(lostRate float64) {
 	}
 	t.trackLock.RUnlock()
 
+	// Prefer the GCC estimate fed by transport-cc feedback; it already
+	// accounts for delay as well as loss and isn't capped at rembHighBW.
+	// The byteRate*loss formula below only runs as a fallback for a
+	// subscriber that never negotiated transport-cc.
 	var bw uint64
-	if lostRate == 0 && t.byteRate == 0 {
-		bw = rembHighBW
-	} else if lostRate >= 0 && lostRate < 0.1 {
-		bw = t.byteRate * 2
+	if tb := t.TargetBitrate(); tb > 0 {
+		bw = tb
 	} else {
-		bw = uint64(float64(t.byteRate) * (1 - lostRate))
-	}
+		if lostRate == 0 && t.byteRate == 0 {
+			bw = rembHighBW
+		} else if lostRate >= 0 && lostRate < 0.1 {
+			bw = t.byteRate * 2
+		} else {
+			bw = uint64(float64(t.byteRate) * (1 - lostRate))
+		}
 
-	if bw < rembLowBW {
-		bw = rembLowBW
-	}
+		if bw < rembLowBW {
+			bw = rembLowBW
+		}
 
-	if bw > rembHighBW {
-		bw = rembHighBW
+		if bw > rembHighBW {
+			bw = rembHighBW
+		}
 	}
 
 	log.Debugf("WebRTCTransport.sendREMB lostRate=%v bw=%v", lostRate, bw*8)
@@ -0,0 +1,273 @@
+package rtc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/ion/pkg/log"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	sdpContentType        = "application/sdp"
+	trickleICEContentType = "application/trickle-ice-sdpfrag"
+
+	whipPathPrefix = "/whip/"
+	whepPathPrefix = "/whep/"
+)
+
+// whipSession is a single WHIP (publish) or WHEP (subscribe) resource -
+// the WebRTCTransport backing it plus the stream id it was created for.
+type whipSession struct {
+	streamID  string
+	transport *WebRTCTransport
+}
+
+var (
+	whipSessionsLock sync.RWMutex
+	whipSessions     = make(map[string]*whipSession)
+
+	// whipPublishers maps a stream id to the transport WHIP published it
+	// with, so a WHEP request for the same stream id knows what to
+	// subscribe to.
+	whipPublishersLock sync.RWMutex
+	whipPublishers     = make(map[string]*WebRTCTransport)
+
+	resourceSeq     uint64
+	resourceSeqLock sync.Mutex
+)
+
+// newResourceID returns a short, process-unique id for a new WHIP/WHEP
+// resource URL.
+func newResourceID() string {
+	resourceSeqLock.Lock()
+	resourceSeq++
+	id := resourceSeq
+	resourceSeqLock.Unlock()
+	return strconv.FormatUint(id, 36)
+}
+
+// WHIPHandler implements the IETF WHIP ingest endpoint
+// (draft-ietf-wish-whip): POST creates a publish session from an SDP
+// offer, DELETE tears it down, and PATCH applies trickle-ICE candidates.
+func WHIPHandler(w http.ResponseWriter, r *http.Request) {
+	streamID, resourceID := parseResourcePath(r.URL.Path, whipPathPrefix)
+	if streamID == "" {
+		http.Error(w, "stream id required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		handlePublishOffer(w, r, streamID)
+	case http.MethodDelete:
+		handleResourceDelete(w, resourceID)
+	case http.MethodPatch:
+		handleResourcePatch(w, r, resourceID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// WHEPHandler implements the IETF WHEP playback endpoint
+// (draft-murillo-whep): POST creates a subscribe session from an SDP
+// offer against whatever WHIP published the same stream id, DELETE tears
+// it down, PATCH applies trickle-ICE candidates.
+func WHEPHandler(w http.ResponseWriter, r *http.Request) {
+	streamID, resourceID := parseResourcePath(r.URL.Path, whepPathPrefix)
+	if streamID == "" {
+		http.Error(w, "stream id required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		handleSubscribeOffer(w, r, streamID)
+	case http.MethodDelete:
+		handleResourceDelete(w, resourceID)
+	case http.MethodPatch:
+		handleResourcePatch(w, r, resourceID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseResourcePath splits "/whip/{stream}" or "/whip/{stream}/{resource}"
+// into its stream and resource ids.
+func parseResourcePath(path, prefix string) (streamID, resourceID string) {
+	trimmed := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if trimmed == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(trimmed, "/", 2)
+	streamID = parts[0]
+	if len(parts) == 2 {
+		resourceID = parts[1]
+	}
+	return streamID, resourceID
+}
+
+// offerVideoCodec scans an SDP offer's "a=rtpmap" lines for the video codec
+// a WHIP publisher is sending, so it can be passed through as
+// AnswerPublish's "codec" option instead of leaving no video codec
+// registered at all. It defaults to "vp8", matching AnswerPublish's own
+// fallback for a named codec it doesn't recognize.
+func offerVideoCodec(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+		codec := strings.SplitN(line, " ", 2)
+		if len(codec) != 2 {
+			continue
+		}
+		name := strings.ToUpper(strings.SplitN(codec[1], "/", 2)[0])
+		switch name {
+		case "H264":
+			return "h264"
+		case "VP9":
+			return "vp9"
+		case "VP8":
+			return "vp8"
+		}
+	}
+	return "vp8"
+}
+
+func handlePublishOffer(w http.ResponseWriter, r *http.Request, streamID string) {
+	if ct := r.Header.Get("Content-Type"); ct != sdpContentType {
+		http.Error(w, "Content-Type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := newWebRTCTransport(streamID)
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	options := map[string]interface{}{"video": true, "audio": true, "codec": offerVideoCodec(offer.SDP)}
+	answer, err := t.AnswerPublish("", offer, options, func(ssrc uint32, pt uint8) {})
+	if err != nil {
+		log.Errorf("WHIPHandler publish err=%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resourceID := newResourceID()
+	whipSessionsLock.Lock()
+	whipSessions[resourceID] = &whipSession{streamID: streamID, transport: t}
+	whipSessionsLock.Unlock()
+
+	whipPublishersLock.Lock()
+	whipPublishers[streamID] = t
+	whipPublishersLock.Unlock()
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%s", whipPathPrefix, streamID, resourceID))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+}
+
+func handleSubscribeOffer(w http.ResponseWriter, r *http.Request, streamID string) {
+	if ct := r.Header.Get("Content-Type"); ct != sdpContentType {
+		http.Error(w, "Content-Type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	whipPublishersLock.RLock()
+	pub, ok := whipPublishers[streamID]
+	whipPublishersLock.RUnlock()
+	if !ok {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+
+	t := newWebRTCTransport(streamID)
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+	answer, err := t.AnswerSubscribe(offer, pub.SSRCPT(), streamID, nil)
+	if err != nil {
+		log.Errorf("WHEPHandler subscribe err=%v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resourceID := newResourceID()
+	whipSessionsLock.Lock()
+	whipSessions[resourceID] = &whipSession{streamID: streamID, transport: t}
+	whipSessionsLock.Unlock()
+
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%s", whepPathPrefix, streamID, resourceID))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+}
+
+func handleResourceDelete(w http.ResponseWriter, resourceID string) {
+	if resourceID == "" {
+		http.Error(w, "resource id required", http.StatusBadRequest)
+		return
+	}
+	whipSessionsLock.Lock()
+	s, ok := whipSessions[resourceID]
+	if ok {
+		delete(whipSessions, resourceID)
+	}
+	whipSessionsLock.Unlock()
+	if !ok {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+
+	whipPublishersLock.Lock()
+	if whipPublishers[s.streamID] == s.transport {
+		delete(whipPublishers, s.streamID)
+	}
+	whipPublishersLock.Unlock()
+
+	s.transport.Close()
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleResourcePatch(w http.ResponseWriter, r *http.Request, resourceID string) {
+	if ct := r.Header.Get("Content-Type"); ct != trickleICEContentType {
+		http.Error(w, "Content-Type must be "+trickleICEContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	whipSessionsLock.RLock()
+	s, ok := whipSessions[resourceID]
+	whipSessionsLock.RUnlock()
+	if !ok {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		candidate := strings.TrimPrefix(line, "a=")
+		if err := s.transport.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+			log.Errorf("WHIPHandler/WHEPHandler AddICECandidate err=%v", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}